@@ -0,0 +1,197 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// addrIndexBucket records, for every pubkey hash, the active chain
+// transactions that pay it or spend its outputs. Keys are the pubkey hash
+// followed by the block height and the transaction ID, so an address's
+// history is a contiguous, height-ordered range. Like the transaction index
+// it is optional and only maintained while the bucket exists.
+const addrIndexBucket = "addrindex"
+
+// ErrAddressIndexDisabled is returned when querying history without the index
+var ErrAddressIndexDisabled = errors.New("address index is disabled")
+
+// addrIndexEntry is the value stored for an address and transaction
+type addrIndexEntry struct {
+	Received int
+	Spends   bool
+}
+
+// AddressTx is an entry of an address's transaction history
+type AddressTx struct {
+	TxID     []byte
+	Height   int
+	Received int
+	Sent     int
+}
+
+func addrIndexKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	return bytes.Join([][]byte{pubKeyHash, heightKey(height), txID}, []byte{})
+}
+
+// addressEntries groups the outputs and inputs of a transaction by the pubkey
+// hash they belong to
+func addressEntries(tx *Transaction) map[string]*addrIndexEntry {
+	entries := make(map[string]*addrIndexEntry)
+	entry := func(pubKeyHash []byte) *addrIndexEntry {
+		if entries[string(pubKeyHash)] == nil {
+			entries[string(pubKeyHash)] = &addrIndexEntry{}
+		}
+		return entries[string(pubKeyHash)]
+	}
+
+	for _, out := range tx.Vout {
+		entry(out.PubKeyHash).Received += out.Value
+	}
+
+	if !tx.IsCoinbase() {
+		for _, vin := range tx.Vin {
+			entry(HashPubKey(vin.PubKey)).Spends = true
+		}
+	}
+
+	return entries
+}
+
+// indexAddresses adds the transactions of a connected block to the index
+func indexAddresses(tx Tx, block *Block) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		for pubKeyHash, entry := range addressEntries(transaction) {
+			var buff bytes.Buffer
+			err := gob.NewEncoder(&buff).Encode(entry)
+			if err != nil {
+				return err
+			}
+
+			key := addrIndexKey([]byte(pubKeyHash), block.Height, transaction.ID)
+			err = b.Put(key, buff.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unindexAddresses removes the transactions of a disconnected block
+func unindexAddresses(tx Tx, block *Block) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		for pubKeyHash := range addressEntries(transaction) {
+			err := b.Delete(addrIndexKey([]byte(pubKeyHash), block.Height, transaction.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReindexAddresses enables the address index and rebuilds it from the active
+// chain
+func (bc *Blockchain) ReindexAddresses() error {
+	return bc.rebuildIndex(addrIndexBucket, indexAddresses)
+}
+
+// DropAddressIndex disables the address index
+func (bc *Blockchain) DropAddressIndex() error {
+	return bc.dropIndex(addrIndexBucket)
+}
+
+// GetAddressHistory returns the transactions funding or spending from the
+// pubkey hash, oldest first
+func (bc *Blockchain) GetAddressHistory(pubKeyHash []byte) ([]AddressTx, error) {
+	var history []AddressTx
+	var spends []bool
+
+	err := bc.Db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(addrIndexBucket))
+		if b == nil {
+			return ErrAddressIndexDisabled
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k, pubKeyHash); k, v = c.Next() {
+			// A longer pubkey hash starting with this one has a longer key
+			if len(k) != len(pubKeyHash)+8+32 {
+				continue
+			}
+
+			var entry addrIndexEntry
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&entry)
+			if err != nil {
+				return err
+			}
+
+			key := k[len(pubKeyHash):]
+			history = append(history, AddressTx{
+				TxID:     append([]byte{}, key[8:]...),
+				Height:   int(binary.BigEndian.Uint64(key[:8])),
+				Received: entry.Received,
+			})
+			spends = append(spends, entry.Spends)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Spent amounts are looked up from the spent outputs rather than stored,
+	// as they are not known to the block being indexed.
+	for i := range history {
+		if !spends[i] {
+			continue
+		}
+
+		sent, err := bc.spentBy(history[i].TxID, pubKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		history[i].Sent = sent
+	}
+
+	return history, nil
+}
+
+// spentBy sums the outputs of pubKeyHash spent by a transaction
+func (bc *Blockchain) spentBy(txID, pubKeyHash []byte) (int, error) {
+	sent := 0
+
+	tx, err := bc.FindTransaction(txID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, vin := range tx.Vin {
+		if !vin.UsesKey(pubKeyHash) {
+			continue
+		}
+
+		prevTx, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return 0, err
+		}
+		sent += prevTx.Vout[vin.Vout].Value
+	}
+
+	return sent, nil
+}
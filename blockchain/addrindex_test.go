@@ -0,0 +1,45 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddressHistoryIgnoresLongerPubKeyHashes(t *testing.T) {
+	bc := newTestChain(t)
+	victim, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+
+	err := bc.ReindexAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mined := mineBlocks(t, bc, address, 1)
+
+	// An output may be locked to any bytes, here the victim's pubkey hash
+	// followed by eight more
+	pubKeyHash := HashPubKey(victim.PublicKey)
+	cbTx, err := NewCoinbaseTX(other, "", 2, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbTx.Vout = append(cbTx.Vout, TXOutput{0, append(append([]byte{}, pubKeyHash...), 1, 2, 3, 4, 5, 6, 7, 8)})
+	cbTx.ID = cbTx.Hash()
+	_, err = bc.MineBlock([]*Transaction{cbTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := bc.GetAddressHistory(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 1 {
+		t.Fatalf("history holds %d transactions, want 1", len(history))
+	}
+	if !bytes.Equal(history[0].TxID, mined[0].Transactions[0].ID) || history[0].Height != 1 {
+		t.Errorf("history entry %x at height %d, want the coinbase at height 1", history[0].TxID, history[0].Height)
+	}
+}
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBase58(t *testing.T) {
+	tests := []struct {
+		decoded, encoded string
+	}{
+		{"", ""},
+		{"00", "1"},
+		{"0000", "11"},
+		{"61", "2g"},
+		{"626262", "a3gV"},
+		{"68656c6c6f20776f726c64", "StV1DL6CwTryKyV"},
+		{"000000287fb4cd", "111233QC4"},
+		{"00eb15231dfceb60925886b67d065299925915aeb172c06647", "1NS17iag9jJgTHD1VXjvLCEnZuQ3rJDE9L"},
+	}
+
+	for _, test := range tests {
+		decoded, err := hex.DecodeString(test.decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := Base58Encode(decoded)
+		if string(encoded) != test.encoded {
+			t.Errorf("%s encodes to %s, want %s", test.decoded, encoded, test.encoded)
+		}
+
+		if back := Base58Decode([]byte(test.encoded)); !bytes.Equal(back, decoded) {
+			t.Errorf("%s decodes to %x, want %s", test.encoded, back, test.decoded)
+		}
+	}
+}
+
+func TestAddressVersions(t *testing.T) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		wallet, err := NewWallet(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A payload led by a zero byte has to keep it through the round trip
+		for _, pubKeyHash := range [][]byte{HashPubKey(wallet.PublicKey), make([]byte, 20)} {
+			payload := append([]byte{params.AddressVersion}, pubKeyHash...)
+			payload = append(payload, checksum(payload)...)
+
+			address := Base58Encode(payload)
+			if !ValidateAddress(string(address), params) {
+				t.Errorf("%s: address %s of %x does not validate", params.Name, address, pubKeyHash)
+			}
+			if back := Base58Decode(address); !bytes.Equal(back, payload) {
+				t.Errorf("%s: address %s decodes to %x, want %x", params.Name, address, back, payload)
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
 	"log"
 	"time"
@@ -14,13 +16,47 @@ type Block struct {
 	Hash          []byte
 	Nonce         int
 	Height        int
+	Bits          int
 }
 
-func newGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+// genesisPubKeyHash locks the genesis block reward. No known key hashes to
+// it, so the reward can never be spent.
+var genesisPubKeyHash = make([]byte, 20)
+
+// GenesisBlock returns the genesis block of the network described by params
+func GenesisBlock(params *ChainParams) *Block {
+	txin := TXInput{[]byte{}, -1, nil, coinbaseData(0, 0, params.GenesisCoinbaseData)}
+	txout := TXOutput{params.Subsidy, genesisPubKeyHash}
+	coinbase := &Transaction{nil, []TXInput{txin}, []TXOutput{txout}}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{
+		params.GenesisTimestamp,
+		[]*Transaction{coinbase},
+		[]byte{},
+		[]byte{},
+		params.GenesisNonce,
+		0,
+		params.GenesisBits,
+	}
+	hash := sha256.Sum256(NewProofOfWork(block).prepareData(block.Nonce))
+	block.Hash = hash[:]
+
+	return block
 }
 
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
+// NewBlock mines a block on top of prevBlockHash with the given difficulty
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height, bits int) (*Block, error) {
+	return NewBlockContext(context.Background(), transactions, prevBlockHash, height, bits)
+}
+
+// NewBlockContext is like NewBlock but gives up mining when ctx is cancelled.
+// It returns ErrNoTransactions if transactions is empty.
+func NewBlockContext(ctx context.Context, transactions []*Transaction, prevBlockHash []byte, height, bits int) (*Block, error) {
+	if len(transactions) == 0 {
+		return nil, ErrNoTransactions
+	}
+
 	block := &Block{
 		time.Now().Unix(),
 		transactions,
@@ -28,14 +64,18 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Bl
 		[]byte{},
 		0,
 		height,
+		bits,
 	}
 	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	nonce, hash, err := pow.RunContext(ctx, MiningWorkers)
+	if err != nil {
+		return nil, err
+	}
 
 	block.Hash = hash[:]
 	block.Nonce = nonce
 
-	return block
+	return block, nil
 }
 
 func (b *Block) Serialize() []byte {
@@ -63,15 +103,15 @@ func (b Block) HashTransactions() []byte {
 	return mtree.RootNode.Data
 }
 
-func DeserializeBlock(data []byte) *Block {
+// DeserializeBlock decodes a block, failing on malformed data
+func DeserializeBlock(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
 	err := decoder.Decode(&block)
-
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return &block
+	return &block, nil
 }
@@ -2,69 +2,134 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	bolt "go.etcd.io/bbolt"
-	"log"
+	"math/big"
 	"os"
 )
 
-const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const genesisCoinbaseData string = "I find your lack of faith disturbing"
+const chainWorkBucket = "chainwork"
 
+// Blockchain is a chain of blocks of the network of Params, kept in a Store
 type Blockchain struct {
-	tip []byte
-	Db  *bolt.DB
+	Db     Store
+	Params *ChainParams
 }
 
+// ErrChainNotFound is returned when opening a blockchain that was not created
+var ErrChainNotFound = errors.New("no existing blockchain found, create one first")
+
+// ErrChainExists is returned when creating a blockchain that already exists
+var ErrChainExists = errors.New("blockchain already exists")
+
+// ErrGenesisMismatch is returned when opening a blockchain that does not
+// start with the network's genesis block
+var ErrGenesisMismatch = errors.New("blockchain does not start with the network's genesis block")
+
+// ErrBlockNotFound is returned when a requested block is not stored
+var ErrBlockNotFound = errors.New("block not found")
+
+// ErrTransactionNotFound is returned when a transaction is not in the chain
+var ErrTransactionNotFound = errors.New("transaction is not found")
+
+// ErrStaleTip is returned when the tip moves while a block is being mined on it
+var ErrStaleTip = errors.New("chain tip changed while mining")
+
 // MineBlock mines a new block with the provided transactions
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	return bc.MineBlockContext(context.Background(), transactions)
+}
+
+// MineBlockContext mines a new block with the provided transactions on the
+// current tip. Mining stops early if ctx is cancelled, and the block is
+// discarded with ErrStaleTip if another block became the tip meanwhile. The
+// block is checked against the tip it was mined on before it is stored, so
+// a coinbase claiming too much or encoding another height is rejected.
+func (bc *Blockchain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
-	var lastHeight int
+	var lastBlock *Block
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
+	if len(transactions) == 0 {
+		return nil, ErrNoTransactions
+	}
+
+	err := bc.Db.View(func(tx Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("1"))
+		// bolt values are only valid for the life of the transaction
+		lastHash = append([]byte{}, b.Get([]byte("1"))...)
+
+		var err error
+		lastBlock, err = loadBlock(b, lastHash)
+		if err != nil {
+			return err
+		}
 
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
+		view, err := utxoViewAt(tx, lastHash, bc.Params)
+		if err != nil {
+			return err
+		}
 
-		lastHeight = block.Height
+		// Check the transactions before spending work on them
+		_, err = bc.checkBlockTransactions(&Block{Transactions: transactions, Height: lastBlock.Height + 1}, view)
 
-		return nil
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
 
+	bits, err := bc.nextBits(lastBlock)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+	newBlock, err := NewBlockContext(ctx, transactions, lastHash, lastBlock.Height+1, bits)
+	if err != nil {
+		return nil, err
+	}
 
-	err = bc.Db.Update(func(tx *bolt.Tx) error {
+	err = bc.Db.Update(func(tx Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
+		if !bytes.Equal(b.Get([]byte("1")), lastHash) {
+			return ErrStaleTip
+		}
+
+		err := checkBlock(newBlock)
+		if err != nil {
+			return err
+		}
+
+		view, err := utxoViewAt(tx, lastHash, bc.Params)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		err = b.Put([]byte("1"), newBlock.Hash)
+		_, err = bc.checkBlockTransactions(newBlock, view)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		bc.tip = newBlock.Hash
+		err = b.Put(newBlock.Hash, newBlock.Serialize())
+		if err != nil {
+			return err
+		}
 
-		return nil
-	})
+		err = putChainWork(tx, newBlock)
+		if err != nil {
+			return err
+		}
 
+		return connectBlock(tx, newBlock)
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return newBlock
+	return newBlock, nil
 }
 
 func dbExists(dbFile string) bool {
@@ -74,150 +139,269 @@ func dbExists(dbFile string) bool {
 	return true
 }
 
-// NewBlockchain creates a new Blockchain with genesis Block
-func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+// NewBlockchain opens the Blockchain kept in the data directory. It returns
+// ErrChainNotFound if the blockchain has not been created yet.
+func NewBlockchain(dataDir DataDir, params *ChainParams) (*Blockchain, error) {
+	dbFile := dataDir.BlockchainFile()
 	if !dbExists(dbFile) {
-		fmt.Printf("could not find blockchain db file: %s\n", dbFile)
-		fmt.Println("No existing blockchain found. Create one first")
-		os.Exit(1)
+		return nil, ErrChainNotFound
 	}
 
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := OpenBoltStore(dbFile)
+	if err != nil {
+		return nil, err
+	}
 
+	bc, err := NewBlockchainWithStore(db, params)
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	return bc, nil
+}
+
+// NewBlockchainWithStore opens the Blockchain kept in db. It returns
+// ErrChainNotFound if db holds no blockchain, and ErrGenesisMismatch if the
+// blockchain belongs to another network. A height index or UTXO set that
+// does not agree with the chain tip is rebuilt.
+func NewBlockchainWithStore(db Store, params *ChainParams) (*Blockchain, error) {
+	var tip []byte
+	var utxoOutOfSync, utxoOutdated bool
+	genesisHash := GenesisBlock(params).Hash
+
+	err := db.Update(func(tx Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("1"))
+		if b == nil {
+			return ErrChainNotFound
+		}
+		tip = append([]byte{}, b.Get([]byte("1"))...)
+
+		if tx.Bucket([]byte(chainWorkBucket)) == nil {
+			err := indexChainWork(tx, tip)
+			if err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket([]byte(metaBucket)) == nil {
+			err := indexHeights(tx, tip)
+			if err != nil {
+				return err
+			}
+		}
+
+		info, err := getTipInfo(tx)
+		if err != nil || !bytes.Equal(info.Hash, tip) {
+			fmt.Println("The height index does not match the chain tip, rebuilding it")
+			err = tx.DeleteBucket([]byte(heightsBucket))
+			if err != nil {
+				return err
+			}
+
+			err = indexHeights(tx, tip)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(tx.Bucket([]byte(heightsBucket)).Get(heightKey(0)), genesisHash) {
+			return ErrGenesisMismatch
+		}
+
+		utxoOutOfSync = !utxoInSync(tx, tip)
+		utxoOutdated = !bytes.Equal(tx.Bucket([]byte(metaBucket)).Get(utxoVersionKey), utxoVersion)
 
 		return nil
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{db, params}
 
-	return &bc
+	if utxoOutdated {
+		fmt.Println("The UTXO set is stored in an older format, rebuilding it")
+	} else if utxoOutOfSync {
+		fmt.Println("The UTXO set does not match the chain tip, rebuilding it")
+	}
+
+	if utxoOutOfSync {
+		UTXOSet := UTXOSet{&bc}
+		err = UTXOSet.Reindex()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &bc, nil
 }
 
-// CreateBlockchain creates a new Blockchain DB
-func CreateBlockchain(address, nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+// CreateBlockchain creates a new Blockchain DB in the data directory holding
+// the network's genesis block. It returns ErrChainExists if the node already
+// has a blockchain.
+func CreateBlockchain(dataDir DataDir, params *ChainParams) (*Blockchain, error) {
+	dbFile := dataDir.BlockchainFile()
 	if dbExists(dbFile) {
-		fmt.Println("Blockchain already exists.")
-		os.Exit(1)
+		return nil, ErrChainExists
 	}
 
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	err := dataDir.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenBoltStore(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := CreateBlockchainWithStore(db, params)
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		os.Remove(dbFile)
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesis := newGenesisBlock(cbtx)
+	return bc, nil
+}
+
+// CreateBlockchainWithStore creates a new Blockchain in db holding the
+// network's genesis block and its UTXO set. It returns ErrChainExists if db
+// already holds a blockchain.
+func CreateBlockchainWithStore(db Store, params *ChainParams) (*Blockchain, error) {
+	genesis := GenesisBlock(params)
 
+	err := db.Update(func(tx Tx) error {
 		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err == ErrBucketExists {
+			return ErrChainExists
+		}
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
 		err = b.Put(genesis.Hash, genesis.Serialize())
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		err = b.Put([]byte("1"), genesis.Hash)
+		_, err = tx.CreateBucket([]byte(chainWorkBucket))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		tip = genesis.Hash
 
-		return nil
-	})
+		err = putChainWork(tx, genesis)
+		if err != nil {
+			return err
+		}
 
+		_, err = tx.CreateBucket([]byte(heightsBucket))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		err = createUTXOBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		return connectBlock(tx, genesis)
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{db, params}
+
+	return &bc, nil
+}
+
+// FindUTXO finds all unspent transaction outputs, keyed by the hex encoding
+// of their UTXO set key
+func (bc *Blockchain) FindUTXO() (map[string]UTXOEntry, error) {
+	tip, err := bc.Tip()
+	if err != nil {
+		return nil, err
+	}
 
-	return &bc
+	return bc.findUTXOAt(tip)
 }
 
-// FindUTXO finds all unspent transaction outputs and returns transactions with
-// spent outputs removed.
-func (bc Blockchain) FindUTXO() map[string]TXOutputs {
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
+// findUTXOAt finds the unspent transaction outputs of the chain ending at
+// blockHash. The chain is walked from blockHash down, and each block's
+// transactions last to first, so that spends are seen before the outputs
+// they spend, even within a block.
+func (bc *Blockchain) findUTXOAt(blockHash []byte) (map[string]UTXOEntry, error) {
+	UTXO := make(map[string]UTXOEntry)
+	spentTXOs := make(map[string]bool)
+	bci := &Iterator{blockHash, bc.Db}
 
 	for bci.currentHash != nil {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 
-		Outputs:
 			for outIdx, out := range tx.Vout {
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
+				key := hex.EncodeToString(outpointKey(tx.ID, outIdx))
+				if !spentTXOs[key] {
+					UTXO[key] = UTXOEntry{out, block.Height, tx.IsCoinbase()}
 				}
-
-				outs := UTXO[txID]
-				outs.Ouputs = append(outs.Ouputs, out)
-				UTXO[txID] = outs
 			}
 
 			if tx.IsCoinbase() == false {
 				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+					spentTXOs[hex.EncodeToString(outpointKey(in.Txid, in.Vout))] = true
 				}
 			}
 		}
 	}
 
-	return UTXO
+	return UTXO, nil
 }
 
 type Iterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	db          Store
 }
 
-func (bc Blockchain) Iterator() *Iterator {
-	return &Iterator{bc.tip, bc.Db}
+// Iterator returns an iterator over the active chain, from its current tip
+// down to the genesis block
+func (bc *Blockchain) Iterator() (*Iterator, error) {
+	tip, err := bc.Tip()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Iterator{tip, bc.Db}, nil
 }
 
-func (i *Iterator) Next() *Block {
+// Next returns the current block and moves the iterator to its parent. It
+// returns nil once the genesis block has been returned.
+func (i *Iterator) Next() (*Block, error) {
 	if i.currentHash == nil {
-		return nil
+		return nil, nil
 	}
 
 	var block *Block
 
-	err := i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-
-		block = DeserializeBlock(b.Get(i.currentHash))
+	err := i.db.View(func(tx Tx) error {
+		var err error
+		block, err = loadBlock(tx.Bucket([]byte(blocksBucket)), i.currentHash)
 
-		return nil
+		return err
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	if block.PrevBlockHash == nil {
@@ -226,15 +410,27 @@ func (i *Iterator) Next() *Block {
 		i.currentHash = block.PrevBlockHash
 	}
 
-	return block
+	return block, nil
 }
 
-// FindTransaction finds a transaction by its ID
+// FindTransaction finds a transaction by its ID, using the transaction index
+// when it is enabled and scanning the chain otherwise
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	bci := bc.Iterator()
+	transaction, indexed, err := bc.findIndexedTransaction(ID)
+	if indexed {
+		return transaction, err
+	}
+
+	bci, err := bc.Iterator()
+	if err != nil {
+		return Transaction{}, err
+	}
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return Transaction{}, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -247,49 +443,85 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("transaction is not found")
+	return Transaction{}, ErrTransactionNotFound
 }
 
 // SignTransaction signs inputs of a transaction
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTxs := make(map[string]Transaction)
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevOuts := make(map[string]TXOutput)
 
 	for _, vin := range tx.Vin {
 		prevTx, err := bc.FindTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return &TxError{tx.ID, ErrMissingInput}
 		}
-		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+		prevOuts[outpointID(vin.Txid, vin.Vout)] = prevTx.Vout[vin.Vout]
 	}
 
-	tx.Sign(privKey, prevTxs)
+	return tx.Sign(privKey, prevOuts)
 }
 
-// GetBestHeight returns the height of the latest block
-func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+// Tip returns the hash of the last block of the active chain
+func (bc *Blockchain) Tip() ([]byte, error) {
+	var tip []byte
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
+	err := bc.Db.View(func(tx Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("1"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+		tip = append([]byte{}, b.Get([]byte("1"))...)
 
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-	return lastBlock.Height
+
+	return tip, err
+}
+
+// GetBestHeight returns the height of the latest block
+func (bc *Blockchain) GetBestHeight() (int, error) {
+	var info tipInfo
+
+	err := bc.Db.View(func(tx Tx) error {
+		var err error
+		info, err = getTipInfo(tx)
+
+		return err
+	})
+
+	return info.Height, err
+}
+
+// GetChainWork returns the cumulative work of the active chain
+func (bc *Blockchain) GetChainWork() (*big.Int, error) {
+	work := new(big.Int)
+
+	err := bc.Db.View(func(tx Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("1"))
+		if tipWork := getChainWork(tx, tip); tipWork != nil {
+			work.Set(tipWork)
+		}
+
+		return nil
+	})
+
+	return work, err
 }
 
 // GetBlockHashes returns a list of hashes of all the blocks in the chain
-func (bc *Blockchain) GetBlockHashes() [][]byte {
+func (bc *Blockchain) GetBlockHashes() ([][]byte, error) {
 	var blocks [][]byte
-	bci := bc.Iterator()
+	bci, err := bc.Iterator()
+	if err != nil {
+		return nil, err
+	}
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		blocks = append(blocks, block.Hash)
 
@@ -298,23 +530,19 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 		}
 
 	}
-	return blocks
+	return blocks, nil
 }
 
 // GetBlock finds a block by its hash and returns it
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-
-		blockData := b.Get(blockHash)
-
-		if blockData == nil {
-			return errors.New("block not found")
+	err := bc.Db.View(func(tx Tx) error {
+		stored, err := loadBlock(tx.Bucket([]byte(blocksBucket)), blockHash)
+		if err != nil {
+			return err
 		}
-
-		block = *DeserializeBlock(blockData)
+		block = *stored
 
 		return nil
 	})
@@ -324,9 +552,47 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// AddBlock saves the block into the blockchain
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.Db.Update(func(tx *bolt.Tx) error {
+// HasBlock reports whether a block with the given hash is stored
+func (bc *Blockchain) HasBlock(blockHash []byte) (bool, error) {
+	var found bool
+
+	err := bc.Db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		found = b.Get(blockHash) != nil
+
+		return nil
+	})
+
+	return found, err
+}
+
+// loadBlock reads and decodes a block from the blocks bucket
+func loadBlock(b Bucket, blockHash []byte) (*Block, error) {
+	blockData := b.Get(blockHash)
+	if blockData == nil {
+		return nil, ErrBlockNotFound
+	}
+
+	return DeserializeBlock(blockData)
+}
+
+// AddBlock validates the block and saves it into the blockchain. Blocks that
+// do not extend the tip are kept as side branches, and the active chain
+// switches to whichever branch has the most cumulative work.
+func (bc *Blockchain) AddBlock(block *Block) error {
+	var detached, attached []*Block
+
+	found, err := bc.HasBlock(block.Hash)
+	if err != nil || found {
+		return err
+	}
+
+	err = bc.ValidateBlock(block)
+	if err != nil {
+		return err
+	}
+
+	err = bc.Db.Update(func(tx Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		blockInDb := b.Get(block.Hash)
 
@@ -337,44 +603,216 @@ func (bc *Blockchain) AddBlock(block *Block) {
 		blockData := block.Serialize()
 		err := b.Put(block.Hash, blockData)
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+
+		err = putChainWork(tx, block)
+		if err != nil {
+			return err
 		}
 
 		lastHash := b.Get([]byte("1"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("1"), block.Hash)
+		if getChainWork(tx, block.Hash).Cmp(getChainWork(tx, lastHash)) <= 0 {
+			fmt.Printf("Block %x stored on a side branch\n", block.Hash)
+			return nil
+		}
+
+		detached, attached, err = findFork(b, lastHash, block.Hash)
+		if err != nil {
+			return err
+		}
+
+		for _, block := range detached {
+			err = disconnectBlock(tx, block)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			bc.tip = block.Hash
 		}
+
+		for _, block := range attached {
+			err = connectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if len(detached) > 0 {
+		for _, block := range detached {
+			fmt.Printf("Disconnected block %x at height %d\n", block.Hash, block.Height)
+		}
+		for _, block := range attached {
+			fmt.Printf("Connected block %x at height %d\n", block.Hash, block.Height)
+		}
+	}
+
+	return nil
+}
+
+// findFork walks back from the old and the new tip until both branches meet.
+// It returns the blocks to disconnect, tip first, and the blocks to connect,
+// in the order they have to be applied.
+func findFork(b Bucket, oldTip, newTip []byte) ([]*Block, []*Block, error) {
+	var detached, attached []*Block
+
+	oldBlock, err := loadBlock(b, oldTip)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	newBlock, err := loadBlock(b, newTip)
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
+	}
+
+	for newBlock.Height > oldBlock.Height {
+		attached = append([]*Block{newBlock}, attached...)
+		newBlock, err = loadBlock(b, newBlock.PrevBlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for oldBlock.Height > newBlock.Height {
+		detached = append(detached, oldBlock)
+		oldBlock, err = loadBlock(b, oldBlock.PrevBlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		detached = append(detached, oldBlock)
+		attached = append([]*Block{newBlock}, attached...)
+
+		oldBlock, err = loadBlock(b, oldBlock.PrevBlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newBlock, err = loadBlock(b, newBlock.PrevBlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return detached, attached, nil
 }
 
-// VerifyTransaction verifies transaction input signatures
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
+// getChainWork returns the cumulative work of the chain ending at blockHash,
+// or nil if the block is unknown
+func getChainWork(tx Tx, blockHash []byte) *big.Int {
+	if len(blockHash) == 0 {
+		return nil
 	}
 
-	prevTXs := make(map[string]Transaction)
+	data := tx.Bucket([]byte(chainWorkBucket)).Get(blockHash)
+	if data == nil {
+		return nil
+	}
 
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
+	return new(big.Int).SetBytes(data)
+}
+
+// putChainWork stores the cumulative work of the chain ending at block
+func putChainWork(tx Tx, block *Block) error {
+	work := NewProofOfWork(block).Work()
+
+	if parentWork := getChainWork(tx, block.PrevBlockHash); parentWork != nil {
+		work.Add(work, parentWork)
+	}
+
+	return tx.Bucket([]byte(chainWorkBucket)).Put(block.Hash, work.Bytes())
+}
+
+// indexChainWork fills the chainwork bucket for databases created before it
+// existed, walking the active chain from genesis up to tip
+func indexChainWork(tx Tx, tip []byte) error {
+	var chain []*Block
+
+	_, err := tx.CreateBucket([]byte(chainWorkBucket))
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(blocksBucket))
+	for hash := tip; len(hash) > 0; {
+		block, err := loadBlock(b, hash)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
+		chain = append(chain, block)
+		hash = block.PrevBlockHash
+	}
 
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	for i := len(chain) - 1; i >= 0; i-- {
+		err = putChainWork(tx, chain[i])
+		if err != nil {
+			return err
+		}
 	}
 
-	return tx.Verify(prevTXs)
+	return nil
+}
+
+// VerifyTransaction checks a transaction against the UTXO set of the active
+// chain: its inputs must spend unspent outputs, cover its outputs and carry
+// valid signatures
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) error {
+	return bc.Db.View(func(dbTx Tx) error {
+		tip := dbTx.Bucket([]byte(blocksBucket)).Get([]byte("1"))
+
+		view, err := utxoViewAt(dbTx, tip, bc.Params)
+		if err != nil {
+			return err
+		}
+
+		_, err = view.checkTransaction(tx)
+
+		return err
+	})
+}
+
+// selectTransactions returns the transactions of txs that can be included in
+// a block on the tip of the active chain, in order, each one checked against
+// the outputs left by those before it. It also returns the sum of their fees
+// and the height of the tip they were checked on.
+func (bc *Blockchain) selectTransactions(txs []*Transaction) ([]*Transaction, int, int, error) {
+	var selected []*Transaction
+	fees, height := 0, 0
+
+	err := bc.Db.View(func(tx Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("1"))
+
+		view, err := utxoViewAt(tx, tip, bc.Params)
+		if err != nil {
+			return err
+		}
+		height = view.height - 1
+
+		for _, transaction := range txs {
+			fee, err := view.checkTransaction(transaction)
+			if err != nil || fee > bc.Params.MaxMoney-fees {
+				continue
+			}
+
+			_, err = view.add(transaction, view.height)
+			if err != nil {
+				continue
+			}
+
+			selected = append(selected, transaction)
+			fees += fee
+		}
+
+		return nil
+	})
+
+	return selected, fees, height, err
 }
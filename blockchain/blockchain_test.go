@@ -0,0 +1,289 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// newTestChain creates a regtest chain held in memory
+func newTestChain(t *testing.T) *Blockchain {
+	bc, err := CreateBlockchainWithStore(NewMemoryStore(), &RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bc
+}
+
+// newTestWallet creates a regtest wallet and returns it with its address
+func newTestWallet(t *testing.T) (*Wallet, string) {
+	wallet, err := NewWallet(&RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wallet, string(wallet.GetAddress())
+}
+
+// mineBlocks mines n blocks on the tip of bc, each holding only a coinbase
+// paying address
+func mineBlocks(t *testing.T, bc *Blockchain, address string, n int) []*Block {
+	var blocks []*Block
+
+	for i := 0; i < n; i++ {
+		height, err := bc.GetBestHeight()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cbTx, err := NewCoinbaseTX(address, "", height+1, 0, bc.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, err := bc.MineBlock([]*Transaction{cbTx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+func TestTipReadWhileMining(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+
+	tx, err := NewUTXOTransaction(wallet, other, 1, 1, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 10; i++ {
+			height, err := bc.GetBestHeight()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			cbTx, err := NewCoinbaseTX(address, "", height+1, 0, bc.Params)
+			if err == nil {
+				_, err = bc.MineBlock([]*Transaction{cbTx})
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		err := bc.VerifyTransaction(tx)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = bc.FindUTXO()
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = bc.GetBlockHashes()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestMineBlockChecksCoinbase(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	mineBlocks(t, bc, address, 1)
+
+	tip, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		height, fees int
+		err          error
+	}{
+		{"coinbase above subsidy and fees", 2, 1000000, ErrBadCoinbaseValue},
+		{"coinbase of another height", 3, 0, ErrBadCoinbaseHeight},
+	}
+
+	for _, test := range tests {
+		cbTx, err := NewCoinbaseTX(address, "", test.height, test.fees, bc.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = bc.MineBlock([]*Transaction{cbTx})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+
+		current, err := bc.Tip()
+		if err != nil || !bytes.Equal(current, tip) {
+			t.Errorf("%s: tip moved to %x, %v", test.name, current, err)
+		}
+	}
+}
+
+func TestMineBlockWithoutTransactions(t *testing.T) {
+	bc := newTestChain(t)
+
+	_, err := bc.MineBlock(nil)
+	if err != ErrNoTransactions {
+		t.Errorf("MineBlock: got %v, want %v", err, ErrNoTransactions)
+	}
+
+	tip, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewBlock(nil, tip, 1, bc.Params.GenesisBits)
+	if err != ErrNoTransactions {
+		t.Errorf("NewBlock: got %v, want %v", err, ErrNoTransactions)
+	}
+
+	// An empty block from a peer is rejected, and hashing it does not panic
+	block := Block{PrevBlockHash: tip, Height: 1, Bits: bc.Params.GenesisBits}
+	err = checkBlock(&block)
+	if err != ErrNoTransactions {
+		t.Errorf("checkBlock: got %v, want %v", err, ErrNoTransactions)
+	}
+	block.HashTransactions()
+}
+
+func TestStartupRepair(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	mineBlocks(t, bc, address, 5)
+	want := dumpBucket(t, bc, utxoBucket)
+
+	err := bc.Db.Update(func(tx Tx) error {
+		err := tx.DeleteBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(metaBucket)).Delete(utxoTipKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewBlockchainWithStore(bc.Db, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := dumpBucket(t, reopened, utxoBucket)
+	if len(got) != len(want) {
+		t.Fatalf("repaired UTXO set holds %d entries, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("repaired UTXO set entry %x differs", k)
+		}
+	}
+}
+
+// checkHeightIndex checks that the height index and tip record of bc match
+// the active chain, found by walking back from its tip
+func checkHeightIndex(t *testing.T, bc *Blockchain) {
+	tip, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := bc.GetBlock(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	best, err := bc.GetBestHeight()
+	if err != nil || best != block.Height {
+		t.Errorf("best height %d, %v, want %d", best, err, block.Height)
+	}
+
+	_, err = bc.GetBlockHashByHeight(block.Height + 1)
+	if err != ErrBlockNotFound {
+		t.Errorf("height above the tip: got %v, want %v", err, ErrBlockNotFound)
+	}
+
+	for {
+		indexed, err := bc.GetBlockByHeight(block.Height)
+		if err != nil || !bytes.Equal(indexed.Hash, block.Hash) {
+			t.Errorf("block at height %d is %x, %v, want %x", block.Height, indexed.Hash, err, block.Hash)
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+		block, err = bc.GetBlock(block.PrevBlockHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHeightIndexFollowsReorgs(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, 3)
+	checkHeightIndex(t, bc)
+
+	side := extendBranch(t, bc, blocks[0].Hash, other, 3)
+	tip, err := bc.Tip()
+	if err != nil || !bytes.Equal(tip, side) {
+		t.Fatalf("tip %x, %v, want the side branch %x", tip, err, side)
+	}
+	checkHeightIndex(t, bc)
+
+	original := extendBranch(t, bc, blocks[2].Hash, address, 2)
+	tip, err = bc.Tip()
+	if err != nil || !bytes.Equal(tip, original) {
+		t.Fatalf("tip %x, %v, want the original branch %x", tip, err, original)
+	}
+	checkHeightIndex(t, bc)
+
+	// Databases created before the index have it built when opened
+	err = bc.Db.Update(func(tx Tx) error {
+		err := tx.DeleteBucket([]byte(heightsBucket))
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteBucket([]byte(metaBucket))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewBlockchainWithStore(bc.Db, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeightIndex(t, reopened)
+}
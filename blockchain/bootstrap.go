@@ -0,0 +1,241 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bootstrapMagic starts every bootstrap file, ahead of its version and the
+// magic of the network its blocks belong to
+var bootstrapMagic = []byte("SBCB")
+
+const bootstrapVersion = 1
+
+// maxBootstrapRecord bounds the length of a block read from a bootstrap
+// file, so that a corrupt length does not exhaust memory
+const maxBootstrapRecord = 32 << 20
+
+// bootstrapProgressInterval is how many blocks are imported between
+// progress messages
+const bootstrapProgressInterval = 1000
+
+// Reasons a bootstrap file can be rejected
+var (
+	ErrNotBootstrapFile    = errors.New("not a bootstrap file")
+	ErrBootstrapVersion    = errors.New("unsupported bootstrap file version")
+	ErrBootstrapNetwork    = errors.New("bootstrap file belongs to another network")
+	ErrBootstrapRecordSize = errors.New("bootstrap file holds a block of invalid length")
+	ErrBootstrapGenesis    = errors.New("bootstrap file does not start with the network's genesis block")
+	ErrBootstrapOutOfOrder = errors.New("bootstrap file holds blocks out of height order")
+)
+
+// gzipMagic starts gzipped files
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ExportChain writes the blocks of the active chain to w in height order, as
+// a bootstrap file. The file starts with bootstrapMagic, the format version
+// and the network magic, followed by each block serialized and prefixed with
+// its length as a big endian uint32. The whole file is gzipped when compress
+// is set. It returns the number of blocks written.
+func (bc *Blockchain) ExportChain(w io.Writer, compress bool) (int, error) {
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		defer zw.Close()
+		w = zw
+	}
+
+	bw := bufio.NewWriter(w)
+
+	header := append([]byte{}, bootstrapMagic...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(bootstrapMagic):], bootstrapVersion)
+	header = append(header, bc.Params.Magic[:]...)
+
+	_, err := bw.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i <= height; i++ {
+		block, err := bc.GetBlockByHeight(i)
+		if err != nil {
+			return i, err
+		}
+
+		data := block.Serialize()
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+		_, err = bw.Write(length[:])
+		if err == nil {
+			_, err = bw.Write(data)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return height + 1, err
+	}
+
+	if zw != nil {
+		return height + 1, zw.Close()
+	}
+
+	return height + 1, nil
+}
+
+// bootstrapReader reads the blocks of a bootstrap file
+type bootstrapReader struct {
+	r      *bufio.Reader
+	zr     *gzip.Reader
+	height int
+}
+
+// newBootstrapReader checks the header of a bootstrap file, gzipped or not,
+// for the network of params. The caller has to close the returned reader.
+func newBootstrapReader(r io.Reader, params *ChainParams) (*bootstrapReader, error) {
+	var zr *gzip.Reader
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil {
+		return nil, ErrNotBootstrapFile
+	}
+
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err = gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(zr)
+	}
+
+	header := make([]byte, len(bootstrapMagic)+4+len(params.Magic))
+	_, err = io.ReadFull(br, header)
+	if err == nil && !bytes.HasPrefix(header, bootstrapMagic) {
+		err = ErrNotBootstrapFile
+	} else if err == nil && binary.BigEndian.Uint32(header[len(bootstrapMagic):]) != bootstrapVersion {
+		err = ErrBootstrapVersion
+	} else if err == nil && !bytes.Equal(header[len(bootstrapMagic)+4:], params.Magic[:]) {
+		err = ErrBootstrapNetwork
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrNotBootstrapFile
+	}
+	if err != nil {
+		if zr != nil {
+			zr.Close()
+		}
+		return nil, err
+	}
+
+	return &bootstrapReader{br, zr, 0}, nil
+}
+
+// Close releases the decompressor of a gzipped file
+func (r *bootstrapReader) Close() error {
+	if r.zr == nil {
+		return nil
+	}
+
+	return r.zr.Close()
+}
+
+// next returns the next block of the file, which has to follow the previous
+// one in height, starting with the genesis block of params. It returns
+// io.EOF at the end of the file.
+func (r *bootstrapReader) next(params *ChainParams) (*Block, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r.r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size == 0 || size > maxBootstrapRecord {
+		return nil, ErrBootstrapRecordSize
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Height != r.height {
+		return nil, ErrBootstrapOutOfOrder
+	}
+
+	if block.Height == 0 && !bytes.Equal(block.Hash, GenesisBlock(params).Hash) {
+		return nil, ErrBootstrapGenesis
+	}
+	r.height++
+
+	return block, nil
+}
+
+// ImportChain validates and adds the blocks of a bootstrap file, gzipped or
+// not. Blocks already stored are skipped, so an interrupted import resumes
+// where it stopped when the same file is imported again. It returns the
+// number of blocks imported and skipped.
+func (bc *Blockchain) ImportChain(r io.Reader) (int, int, error) {
+	imported, skipped := 0, 0
+
+	br, err := newBootstrapReader(r, bc.Params)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer br.Close()
+
+	for {
+		block, err := br.next(bc.Params)
+		if err == io.EOF {
+			return imported, skipped, nil
+		}
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		found, err := bc.HasBlock(block.Hash)
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		if found {
+			skipped++
+			continue
+		}
+
+		err = bc.AddBlock(block)
+		if err != nil {
+			return imported, skipped, err
+		}
+		imported++
+
+		if imported%bootstrapProgressInterval == 0 {
+			fmt.Printf("Imported blocks up to height %d\n", block.Height)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportChain(t *testing.T) {
+	source := newTestChain(t)
+	_, address := newTestWallet(t)
+	mineBlocks(t, source, address, 6)
+	want := dumpBucket(t, source, utxoBucket)
+
+	for _, compress := range []bool{false, true} {
+		var file bytes.Buffer
+		exported, err := source.ExportChain(&file, compress)
+		if err != nil || exported != 7 {
+			t.Fatalf("compress %v: exported %d blocks, %v, want 7", compress, exported, err)
+		}
+
+		// An import cut short keeps the blocks read before it stopped, and
+		// importing the whole file again only adds the rest
+		bc := newTestChain(t)
+		imported, _, err := bc.ImportChain(bytes.NewReader(file.Bytes()[:file.Len()*2/3]))
+		if err == nil || imported == 0 || imported >= 6 {
+			t.Fatalf("compress %v: truncated file imported %d blocks, %v", compress, imported, err)
+		}
+
+		resumed, skipped, err := bc.ImportChain(bytes.NewReader(file.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed != 6-imported || skipped != 1+imported {
+			t.Errorf("compress %v: resumed with %d blocks imported and %d skipped, want %d and %d", compress, resumed, skipped, 6-imported, 1+imported)
+		}
+
+		tip, err := bc.Tip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sourceTip, err := source.Tip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tip, sourceTip) {
+			t.Errorf("compress %v: tip %x after import, want %x", compress, tip, sourceTip)
+		}
+
+		got := dumpBucket(t, bc, utxoBucket)
+		if len(got) != len(want) {
+			t.Errorf("compress %v: UTXO set holds %d entries after import, want %d", compress, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("compress %v: UTXO set entry %x differs after import", compress, k)
+			}
+		}
+
+		imported, skipped, err = bc.ImportChain(bytes.NewReader(file.Bytes()))
+		if err != nil || imported != 0 || skipped != 7 {
+			t.Errorf("compress %v: imported %d and skipped %d blocks again, %v, want 0 and 7", compress, imported, skipped, err)
+		}
+	}
+}
+
+func TestImportChainRejections(t *testing.T) {
+	source := newTestChain(t)
+	var file bytes.Buffer
+	_, err := source.ExportChain(&file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := RegTestParams
+	params.Magic = MainNetParams.Magic
+	bc := newTestChain(t)
+	bc.Params = &params
+
+	_, _, err = bc.ImportChain(bytes.NewReader(file.Bytes()))
+	if err != ErrBootstrapNetwork {
+		t.Errorf("file of another network: got %v, want %v", err, ErrBootstrapNetwork)
+	}
+
+	_, _, err = bc.ImportChain(bytes.NewReader([]byte("not a bootstrap file")))
+	if err != ErrNotBootstrapFile {
+		t.Errorf("other file: got %v, want %v", err, ErrNotBootstrapFile)
+	}
+}
@@ -0,0 +1,219 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+)
+
+const heightsBucket = "heights"
+const metaBucket = "meta"
+
+var tipKey = []byte("tip")
+
+// tipInfo is a small record describing the tip of the active chain, so that
+// reading its height does not require loading the whole block
+type tipInfo struct {
+	Hash   []byte
+	Height int
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+
+	return key
+}
+
+// connectBlock makes block the tip of the active chain, indexes it and
+// applies it to the UTXO set, all within tx so that a crash cannot leave
+// them disagreeing
+func connectBlock(tx Tx, block *Block) error {
+	err := indexBlock(tx, block)
+	if err != nil {
+		return err
+	}
+
+	return connectUTXO(tx, block)
+}
+
+// disconnectBlock removes the tip block from the height, transaction and
+// address indexes and reverts its UTXO set changes. The tip itself is moved
+// by connecting the blocks of the new active chain.
+func disconnectBlock(tx Tx, block *Block) error {
+	err := unindexTransactions(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = unindexAddresses(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte(heightsBucket)).Delete(heightKey(block.Height))
+	if err != nil {
+		return err
+	}
+
+	return disconnectUTXO(tx, block)
+}
+
+// truncateChain removes the blocks of the active chain from height from up
+// to to, and the index entries of their transactions, and makes the block
+// below them the tip. The UTXO set has to end below them.
+func truncateChain(tx Tx, from, to int) error {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	heights := tx.Bucket([]byte(heightsBucket))
+
+	if from == 0 {
+		return ErrGenesisMismatch
+	}
+
+	for height := to; height >= from; height-- {
+		block, err := loadBlock(blocks, heights.Get(heightKey(height)))
+		if err != nil {
+			return err
+		}
+
+		err = unindexTransactions(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = unindexAddresses(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = heights.Delete(heightKey(height))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket([]byte(chainWorkBucket)).Delete(block.Hash)
+		if err != nil {
+			return err
+		}
+
+		err = blocks.Delete(block.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	tip, err := loadBlock(blocks, heights.Get(heightKey(from-1)))
+	if err != nil {
+		return err
+	}
+
+	return putTip(tx, tip)
+}
+
+// indexBlock makes block the tip of the active chain and indexes it
+func indexBlock(tx Tx, block *Block) error {
+	err := tx.Bucket([]byte(heightsBucket)).Put(heightKey(block.Height), block.Hash)
+	if err != nil {
+		return err
+	}
+
+	err = indexTransactions(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = indexAddresses(tx, block)
+	if err != nil {
+		return err
+	}
+
+	return putTip(tx, block)
+}
+
+// putTip records block as the tip of the active chain
+func putTip(tx Tx, block *Block) error {
+	err := tx.Bucket([]byte(blocksBucket)).Put([]byte("1"), block.Hash)
+	if err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(tipInfo{block.Hash, block.Height})
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(metaBucket)).Put(tipKey, buff.Bytes())
+}
+
+// getTipInfo reads the tip record
+func getTipInfo(tx Tx) (tipInfo, error) {
+	var info tipInfo
+
+	data := tx.Bucket([]byte(metaBucket)).Get(tipKey)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info)
+
+	return info, err
+}
+
+// indexHeights creates the height index and tip record for databases created
+// before they existed
+func indexHeights(tx Tx, tip []byte) error {
+	var chain []*Block
+
+	_, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(blocksBucket))
+	for hash := tip; len(hash) > 0; {
+		block, err := loadBlock(b, hash)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, block)
+		hash = block.PrevBlockHash
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		err = indexBlock(tx, chain[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetBlockHashByHeight returns the hash of the active chain's block at height
+func (bc *Blockchain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.Db.View(func(tx Tx) error {
+		data := tx.Bucket([]byte(heightsBucket)).Get(heightKey(height))
+		if data == nil {
+			return ErrBlockNotFound
+		}
+		hash = append([]byte{}, data...)
+
+		return nil
+	})
+
+	return hash, err
+}
+
+// GetBlockByHeight returns the active chain's block at height
+func (bc *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := bc.GetBlockHashByHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return bc.GetBlock(hash)
+}
@@ -1,6 +1,7 @@
 package blockchain
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -14,32 +15,60 @@ type CLI struct {
 
 const (
 	createBlockchainFlag  string = "createblockchain"
-	createBlockchainUsage string = "  %s -address <address> - create a blockchain and send genesis block reward to <address>"
+	createBlockchainUsage string = "  %s - create a blockchain holding the network's genesis block"
 	printChainFlag        string = "printchain"
 	printChainUsage       string = "  %s - print all the blocks of the blockchain"
 	getBalanceFlag        string = "getbalance"
 	getBalanceUsage       string = "  %s -address <address> - calculate the balance of <address>"
+	getSupplyFlag         string = "getsupply"
+	getSupplyUsage        string = "  %s - report the coins issued so far and the emission schedule"
 	sendFlag              string = "send"
-	sendUsage             string = "  %s -from <from> -to <to> -amount <amount> -mine - Send <amount> from <from> to <to>. Mine on the same node, when -mine is set."
+	sendUsage             string = "  %s -from <from> -to <to> -amount <amount> -fee <fee> -mine - Send <amount> from <from> to <to>, paying <fee> to the miner. Mine on the same node, when -mine is set."
+	generateFlag          string = "generate"
+	generateUsage         string = "  %s -address <address> -blocks <n> - mine <n> blocks paying their reward to <address>"
 	createWalletFlag      string = "createwallet"
 	createWalletUsage     string = "  %s - generates a new key-pair and saves it into the wallet file"
+	verifyChainFlag       string = "verifychain"
+	verifyChainUsage      string = "  %s -depth <n> -level <0-3> - recheck the last <n> blocks, or all when <n> is 0: 0 checks linkage, 1 headers and proof of work, 2 transactions and signatures, 3 also recomputes the UTXO set"
+	exportChainFlag       string = "exportchain"
+	exportChainUsage      string = "  %s -file <file> -gzip - write the blocks of the chain to a bootstrap file, gzipped when -gzip is set"
+	importChainFlag       string = "importchain"
+	importChainUsage      string = "  %s -file <file> - validate and add the blocks of a bootstrap file, resuming an interrupted import"
+	dumpUTXOFlag          string = "dumputxo"
+	dumpUTXOUsage         string = "  %s -file <file> - write the UTXO set at the chain tip to a snapshot file"
+	loadUTXOFlag          string = "loadutxo"
+	loadUTXOUsage         string = "  %s -file <file> -blocks <file> - bootstrap an empty chain from a UTXO snapshot and a bootstrap file holding the blocks up to its tip. The node validates the chain history in the background."
 	reindexUTXOFlag       string = "reindexutxo"
-	reindexUTXOUsage      string = "  %s - Rebuilds the UTXO set"
+	reindexUTXOUsage      string = "  %s - Rebuilds the UTXO set, validating first the chain history behind a UTXO snapshot the chain was bootstrapped from"
+	reindexTxFlag         string = "reindextx"
+	reindexTxUsage        string = "  %s -disable - Rebuilds the transaction index, or removes it when -disable is set"
+	reindexAddrFlag       string = "reindexaddr"
+	reindexAddrUsage      string = "  %s -disable - Rebuilds the address index, or removes it when -disable is set"
+	getHistoryFlag        string = "gethistory"
+	getHistoryUsage       string = "  %s -address <address> - list the transactions funding or spending from <address>"
 	startNodeFlag         string = "startnode"
-	startNodeUsage        string = "  %s -miner <address> -Start a node with ID specified in NODE_ID env var -miner enabled mining"
+	startNodeUsage        string = "  %s -miner <address> -workers <n> -Start a node listening on the port in NODE_ID env var, or the network's default port -miner enabled mining using <n> goroutines"
 	listAddressesFlag     string = "listaddresses"
 	listAddressesUsage    string = "  %s - Lists all addresses from the wallet file"
+	dataDirFlag           string = "datadir"
+	dataDirUsage          string = "All commands accept -%s <dir>, the directory holding the node's files. It defaults to $%s or ~/.simple-blockchain, in a subdirectory named after NODE_ID when it is set."
+	networkFlag           string = "network"
+	networkUsage          string = "All commands accept -%s <name>, the network to use: main (default), test or regtest."
 )
 
-func (cli *CLI) createBlockchain(address, nodeID string) {
-	if !ValidateAddress(address) {
-		log.Panic("error: Address is not valid")
+// exitOnError reports err and exits. The library returns errors and leaves
+// exiting to the CLI.
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
-	bc := CreateBlockchain(address, nodeID)
-	defer bc.Db.Close()
+}
 
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
+func (cli *CLI) createBlockchain(dataDir DataDir, params *ChainParams) {
+	bc, err := CreateBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
 
 	fmt.Println("Done!")
 }
@@ -49,76 +78,326 @@ func (cli *CLI) printUsage() {
 	fmt.Println(fmt.Sprintf(createBlockchainUsage, createBlockchainFlag))
 	fmt.Println(fmt.Sprintf(printChainUsage, printChainFlag))
 	fmt.Println(fmt.Sprintf(getBalanceUsage, getBalanceFlag))
+	fmt.Println(fmt.Sprintf(getSupplyUsage, getSupplyFlag))
 	fmt.Println(fmt.Sprintf(sendUsage, sendFlag))
+	fmt.Println(fmt.Sprintf(generateUsage, generateFlag))
 	fmt.Println(fmt.Sprintf(createWalletUsage, createWalletFlag))
+	fmt.Println(fmt.Sprintf(verifyChainUsage, verifyChainFlag))
+	fmt.Println(fmt.Sprintf(exportChainUsage, exportChainFlag))
+	fmt.Println(fmt.Sprintf(importChainUsage, importChainFlag))
+	fmt.Println(fmt.Sprintf(dumpUTXOUsage, dumpUTXOFlag))
+	fmt.Println(fmt.Sprintf(loadUTXOUsage, loadUTXOFlag))
 	fmt.Println(fmt.Sprintf(reindexUTXOUsage, reindexUTXOFlag))
+	fmt.Println(fmt.Sprintf(reindexTxUsage, reindexTxFlag))
+	fmt.Println(fmt.Sprintf(reindexAddrUsage, reindexAddrFlag))
+	fmt.Println(fmt.Sprintf(getHistoryUsage, getHistoryFlag))
 	fmt.Println(fmt.Sprintf(startNodeUsage, startNodeFlag))
 	fmt.Println(fmt.Sprintf(listAddressesUsage, listAddressesFlag))
+	fmt.Println(fmt.Sprintf(dataDirUsage, dataDirFlag, DataDirEnv))
+	fmt.Println(fmt.Sprintf(networkUsage, networkFlag))
 }
 
-func (cli CLI) getBalance(address string, nodeID string) {
-	if !ValidateAddress(address) {
+func (cli CLI) getBalance(address string, dataDir DataDir, params *ChainParams) {
+	if !ValidateAddress(address, params) {
 		log.Panic("error: address is not valid")
 	}
-	bc := NewBlockchain(nodeID)
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
 	UTXOSet := UTXOSet{bc}
 	defer bc.Db.Close()
 
-	var balance int
 	pubKeyHash := Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance, immature, err := UTXOSet.Balance(pubKeyHash)
+	exitOnError(err)
 	fmt.Printf("Balance of `%s` is `%d`\n", address, balance)
+	fmt.Printf("Immature coinbase rewards: `%d`\n", immature)
 }
 
-func (cli CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !ValidateAddress(from) {
+func (cli CLI) getSupply(dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	UTXOSet := UTXOSet{bc}
+	defer bc.Db.Close()
+
+	height, err := bc.GetBestHeight()
+	exitOnError(err)
+	issued, err := UTXOSet.Supply()
+	exitOnError(err)
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Issued: %d\n", issued)
+	fmt.Printf("Scheduled: %d\n", params.IssuedSupply(height))
+	fmt.Printf("Next block subsidy: %d\n", params.BlockSubsidy(height+1))
+	fmt.Printf("Halving interval: %d blocks\n", params.HalvingInterval)
+	fmt.Printf("Max supply: %d\n", params.MaxSupply())
+}
+
+func (cli CLI) send(from, to string, amount, fee int, dataDir DataDir, params *ChainParams, mineNow bool) {
+	if !ValidateAddress(from, params) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
 
-	if !ValidateAddress(to) {
+	if !ValidateAddress(to, params) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
-	bc := NewBlockchain(nodeID)
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
 	UTXOSet := UTXOSet{bc}
 	defer bc.Db.Close()
 
-	wallets, err := NewWallets(nodeID)
-	if err != nil {
-		log.Panic(err)
-	}
-	wallet := wallets.GetWallet(from)
+	wallets, err := NewWallets(dataDir, params)
+	exitOnError(err)
+	wallet, err := wallets.GetWallet(from)
+	exitOnError(err)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := NewUTXOTransaction(&wallet, to, amount, fee, &UTXOSet)
+	exitOnError(err)
 
 	if mineNow {
-		cbTx := NewCoinbaseTX(from, "")
+		height, err := bc.GetBestHeight()
+		exitOnError(err)
+
+		cbTx, err := NewCoinbaseTX(from, "", height+1, fee, params)
+		exitOnError(err)
 		txs := []*Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err = bc.MineBlock(txs)
+		exitOnError(err)
 	} else {
-		sendTx(knownNodes[0], tx)
+		if centralNode(params) == "" {
+			fmt.Printf("The %s network has no node to send the transaction to\n", params.Name)
+			os.Exit(1)
+		}
+		sendTx(centralNode(params), params, tx)
 	}
 
 	fmt.Println("Success!")
 }
 
-func (cli CLI) createWallet(nodeID string) {
-	wallets, _ := NewWallets(nodeID)
-	address := wallets.CreateWallet()
-	wallets.SaveToFile(nodeID)
+// generate mines blocks holding only their coinbase, which is how the first
+// coins of a network are created
+func (cli CLI) generate(address string, blocks int, dataDir DataDir, params *ChainParams) {
+	if !ValidateAddress(address, params) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	for i := 0; i < blocks; i++ {
+		height, err := bc.GetBestHeight()
+		exitOnError(err)
+
+		cbTx, err := NewCoinbaseTX(address, "", height+1, 0, params)
+		exitOnError(err)
+
+		newBlock, err := bc.MineBlock([]*Transaction{cbTx})
+		exitOnError(err)
+
+		fmt.Printf("Mined block %x at height %d\n", newBlock.Hash, newBlock.Height)
+	}
+}
+
+func (cli CLI) createWallet(dataDir DataDir, params *ChainParams) {
+	wallets, err := NewWallets(dataDir, params)
+	if !os.IsNotExist(err) {
+		exitOnError(err)
+	}
+	address, err := wallets.CreateWallet()
+	exitOnError(err)
+	exitOnError(wallets.SaveToFile(dataDir))
 
 	fmt.Printf("Your new address: %s\n", address)
 }
 
-func (cli *CLI) reindexUTXO(nodeID string) {
-	bc := NewBlockchain(nodeID)
+func (cli *CLI) verifyChain(depth, level int, dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	height, err := bc.GetBestHeight()
+	exitOnError(err)
+
+	if depth <= 0 || depth > height+1 {
+		depth = height + 1
+	}
+	fmt.Printf("Verifying the last %d blocks at level %d\n", depth, level)
+
+	exitOnError(bc.VerifyChain(depth, level))
+	fmt.Println("No problems found")
+}
+
+// exportChain writes the bootstrap file next to file and renames it once
+// complete, so an interrupted export does not leave a truncated file behind
+func (cli *CLI) exportChain(file string, compress bool, dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	tmpFile := file + ".tmp"
+	f, err := os.Create(tmpFile)
+	exitOnError(err)
+
+	blocks, err := bc.ExportChain(f, compress)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		exitOnError(err)
+	}
+	exitOnError(os.Rename(tmpFile, file))
+
+	fmt.Printf("Exported %d blocks to %s\n", blocks, file)
+}
+
+func (cli *CLI) importChain(file string, dataDir DataDir, params *ChainParams) {
+	f, err := os.Open(file)
+	exitOnError(err)
+	defer f.Close()
+
+	bc, err := NewBlockchain(dataDir, params)
+	if err == ErrChainNotFound {
+		bc, err = CreateBlockchain(dataDir, params)
+	}
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	imported, skipped, err := bc.ImportChain(f)
+	fmt.Printf("Imported %d blocks, skipped %d already stored\n", imported, skipped)
+	exitOnError(err)
+
+	height, err := bc.GetBestHeight()
+	exitOnError(err)
+	fmt.Printf("Chain tip is at height %d\n", height)
+}
+
+func (cli *CLI) dumpUTXO(file string, dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	tmpFile := file + ".tmp"
+	f, err := os.Create(tmpFile)
+	exitOnError(err)
+
+	UTXOSet := UTXOSet{bc}
+	info, err := UTXOSet.Dump(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		exitOnError(err)
+	}
+	exitOnError(os.Rename(tmpFile, file))
+
+	fmt.Printf("Dumped the UTXO set at block %x, height %d, to %s\n", info.Hash, info.Height, file)
+	fmt.Printf("Commitment: %x\n", info.Commitment)
+}
+
+func (cli *CLI) loadUTXO(file, blocksFile string, dataDir DataDir, params *ChainParams) {
+	snapshot, err := os.Open(file)
+	exitOnError(err)
+	defer snapshot.Close()
+
+	blocks, err := os.Open(blocksFile)
+	exitOnError(err)
+	defer blocks.Close()
+
+	bc, err := NewBlockchain(dataDir, params)
+	if err == ErrChainNotFound {
+		bc, err = CreateBlockchain(dataDir, params)
+	}
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	info, err := bc.LoadUTXOSnapshot(snapshot, blocks)
+	exitOnError(err)
+
+	fmt.Printf("Loaded the UTXO set at block %x, height %d\n", info.Hash, info.Height)
+	fmt.Printf("Commitment: %x\n", info.Commitment)
+	fmt.Println("The chain history is validated in the background once the node starts")
+}
+
+func (cli *CLI) reindexUTXO(dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	// A UTXO set rebuilt from the blocks no longer comes from the snapshot
+	// the chain was bootstrapped from, so the blocks under it are validated
+	// first. Rejecting the snapshot rebuilds the set already.
+	err = bc.ValidateSnapshot()
+	var serr *SnapshotError
+	if errors.As(err, &serr) {
+		fmt.Printf("The UTXO snapshot is not valid: %s\n", err)
+		return
+	}
+	exitOnError(err)
+
 	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
+	exitOnError(UTXOSet.Reindex())
+}
+
+func (cli *CLI) reindexTx(dataDir DataDir, params *ChainParams, disable bool) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	if disable {
+		exitOnError(bc.DropTransactionIndex())
+		fmt.Println("Transaction index removed")
+		return
+	}
+
+	exitOnError(bc.ReindexTransactions())
+	fmt.Println("Done!")
+}
+
+func (cli *CLI) reindexAddr(dataDir DataDir, params *ChainParams, disable bool) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	if disable {
+		exitOnError(bc.DropAddressIndex())
+		fmt.Println("Address index removed")
+		return
+	}
+
+	exitOnError(bc.ReindexAddresses())
+	fmt.Println("Done!")
+}
+
+func (cli CLI) getHistory(address string, dataDir DataDir, params *ChainParams) {
+	if !ValidateAddress(address, params) {
+		log.Panic("error: address is not valid")
+	}
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
+	defer bc.Db.Close()
+
+	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	history, err := bc.GetAddressHistory(pubKeyHash)
+	if err == ErrAddressIndexDisabled {
+		fmt.Printf("The address index is disabled, enable it with %s\n", reindexAddrFlag)
+		os.Exit(1)
+	}
+	exitOnError(err)
+
+	fmt.Printf("History of `%s`:\n", address)
+	for _, entry := range history {
+		fmt.Printf("Height: %d Tx: %x Received: %d Sent: %d\n", entry.Height, entry.TxID, entry.Received, entry.Sent)
+	}
 }
 
 func (cli *CLI) Run() {
@@ -128,27 +407,54 @@ func (cli *CLI) Run() {
 	}
 
 	nodeID := os.Getenv("NODE_ID")
-	if nodeID == "" {
-		fmt.Printf("NODE_ID env. var is not set!")
-		os.Exit(1)
-	}
 
 	createBlockchainCmd := flag.NewFlagSet(createBlockchainFlag, flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet(printChainFlag, flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet(getBalanceFlag, flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet(getSupplyFlag, flag.ExitOnError)
 	sendCmd := flag.NewFlagSet(sendFlag, flag.ExitOnError)
+	generateCmd := flag.NewFlagSet(generateFlag, flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet(createWalletFlag, flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet(verifyChainFlag, flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet(exportChainFlag, flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet(importChainFlag, flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet(dumpUTXOFlag, flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet(loadUTXOFlag, flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet(reindexUTXOFlag, flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet(reindexTxFlag, flag.ExitOnError)
+	reindexAddrCmd := flag.NewFlagSet(reindexAddrFlag, flag.ExitOnError)
+	getHistoryCmd := flag.NewFlagSet(getHistoryFlag, flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet(startNodeFlag, flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet(listAddressesFlag, flag.ExitOnError)
 
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "Recipient of the genesis block reward")
 	getBalanceAddress := getBalanceCmd.String("address", "", "Get the balance of this address")
 	sendFromAddress := sendCmd.String("from", "", "Address to take funds from")
 	sendToAddress := sendCmd.String("to", "", "Address to send funds to")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to transfer")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	generateAddress := generateCmd.String("address", "", "Recipient of the block rewards")
+	generateBlocks := generateCmd.Int("blocks", 1, "Number of blocks to mine")
+	verifyChainDepth := verifyChainCmd.Int("depth", 0, "Number of blocks to check from the tip, 0 for all")
+	verifyChainLevel := verifyChainCmd.Int("level", VerifyUTXOSet, "How thoroughly to check the blocks, from 0 to 3")
+	exportChainFile := exportChainCmd.String("file", "", "Bootstrap file to write")
+	exportChainGzip := exportChainCmd.Bool("gzip", false, "Compress the bootstrap file with gzip")
+	importChainFile := importChainCmd.String("file", "", "Bootstrap file to read")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "Snapshot file to write")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "Snapshot file to read")
+	loadUTXOBlocks := loadUTXOCmd.String("blocks", "", "Bootstrap file holding the blocks up to the snapshot")
+	reindexTxDisable := reindexTxCmd.Bool("disable", false, "Remove the transaction index")
+	reindexAddrDisable := reindexAddrCmd.Bool("disable", false, "Remove the address index")
+	getHistoryAddress := getHistoryCmd.String("address", "", "List the history of this address")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeWorkers := startNodeCmd.Int("workers", MiningWorkers, "Number of goroutines used for mining")
+
+	var dataDirPath, network string
+	for _, cmd := range []*flag.FlagSet{createBlockchainCmd, printChainCmd, getBalanceCmd, getSupplyCmd, sendCmd, generateCmd, createWalletCmd,
+		verifyChainCmd, exportChainCmd, importChainCmd, dumpUTXOCmd, loadUTXOCmd, reindexUTXOCmd, reindexTxCmd, reindexAddrCmd, getHistoryCmd, startNodeCmd, listAddressesCmd} {
+		cmd.StringVar(&dataDirPath, dataDirFlag, "", "Directory holding the node's files")
+		cmd.StringVar(&network, networkFlag, DefaultNetwork, "Network to use: main, test or regtest")
+	}
 
 	switch os.Args[1] {
 	case createBlockchainFlag:
@@ -166,21 +472,71 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case getSupplyFlag:
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case sendFlag:
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case generateFlag:
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case createWalletFlag:
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case verifyChainFlag:
+		err := verifyChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case exportChainFlag:
+		err := exportChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case importChainFlag:
+		err := importChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case dumpUTXOFlag:
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case loadUTXOFlag:
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case reindexUTXOFlag:
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case reindexTxFlag:
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case reindexAddrFlag:
+		err := reindexAddrCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case getHistoryFlag:
+		err := getHistoryCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case startNodeFlag:
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -196,16 +552,29 @@ func (cli *CLI) Run() {
 		os.Exit(1)
 	}
 
-	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			os.Exit(1)
+	params, err := ParamsForNetwork(network)
+	exitOnError(err)
+
+	dataDir := NewDataDir(dataDirPath, params.Name, nodeID)
+	lock, err := dataDir.Lock()
+	exitOnError(err)
+	defer lock.Unlock()
+
+	if params.Name == DefaultNetwork {
+		legacyFile := LegacyWalletFile(nodeID)
+		migrated, err := MigrateLegacyWallets(legacyFile, dataDir, params)
+		exitOnError(err)
+		if migrated > 0 {
+			fmt.Printf("Moved %d keys from %s to %s, the old file can be removed\n", migrated, legacyFile, dataDir.WalletFile())
 		}
-		cli.createBlockchain(*createBlockchainAddress, nodeID)
+	}
+
+	if createBlockchainCmd.Parsed() {
+		cli.createBlockchain(dataDir, params)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+		cli.printChain(dataDir, params)
 	}
 
 	if getBalanceCmd.Parsed() {
@@ -213,55 +582,112 @@ func (cli *CLI) Run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress, dataDir, params)
+	}
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(dataDir, params)
 	}
 	if sendCmd.Parsed() {
-		if *sendFromAddress == "" || *sendToAddress == "" || *sendAmount == 0 {
+		if *sendFromAddress == "" || *sendToAddress == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFromAddress, *sendToAddress, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFromAddress, *sendToAddress, *sendAmount, *sendFee, dataDir, params, *sendMine)
+	}
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateBlocks <= 0 {
+			generateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.generate(*generateAddress, *generateBlocks, dataDir, params)
 	}
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(dataDir, params)
+	}
+	if verifyChainCmd.Parsed() {
+		if *verifyChainDepth < 0 || *verifyChainLevel < VerifyLinkage || *verifyChainLevel > VerifyUTXOSet {
+			verifyChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyChain(*verifyChainDepth, *verifyChainLevel, dataDir, params)
+	}
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" {
+			exportChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.exportChain(*exportChainFile, *exportChainGzip, dataDir, params)
+	}
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			importChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importChain(*importChainFile, dataDir, params)
+	}
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpUTXO(*dumpUTXOFile, dataDir, params)
+	}
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" || *loadUTXOBlocks == "" {
+			loadUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadUTXO(*loadUTXOFile, *loadUTXOBlocks, dataDir, params)
 	}
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO(nodeID)
+		cli.reindexUTXO(dataDir, params)
 	}
-	if startNodeCmd.Parsed() {
-		nodeID := os.Getenv("NODE_ID")
-		if nodeID == "" {
-			startNodeCmd.Usage()
+	if reindexTxCmd.Parsed() {
+		cli.reindexTx(dataDir, params, *reindexTxDisable)
+	}
+	if reindexAddrCmd.Parsed() {
+		cli.reindexAddr(dataDir, params, *reindexAddrDisable)
+	}
+	if getHistoryCmd.Parsed() {
+		if *getHistoryAddress == "" {
+			getHistoryCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		cli.getHistory(*getHistoryAddress, dataDir, params)
+	}
+	if startNodeCmd.Parsed() {
+		MiningWorkers = *startNodeWorkers
+		cli.startNode(dataDir, params, nodeID, *startNodeMiner)
 	}
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses(dataDir, params)
 	}
 }
 
-func (cli *CLI) startNode(nodeId, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeId)
+func (cli *CLI) startNode(dataDir DataDir, params *ChainParams, nodeId, minerAddress string) {
+	fmt.Printf("Starting %s node %s\n", params.Name, nodeId)
 	if len(minerAddress) > 0 {
-		if ValidateAddress(minerAddress) {
+		if ValidateAddress(minerAddress, params) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
 		} else {
 			log.Panic("Invalid miner address!")
 		}
 	}
-	StartServer(nodeId, minerAddress)
+	exitOnError(StartServer(dataDir, params, nodeId, minerAddress))
 }
 
-func (cli CLI) printChain(nodeID string) {
-	bc := NewBlockchain(nodeID)
+func (cli CLI) printChain(dataDir DataDir, params *ChainParams) {
+	bc, err := NewBlockchain(dataDir, params)
+	exitOnError(err)
 	defer bc.Db.Close()
 
-	bci := bc.Iterator()
+	bci, err := bc.Iterator()
+	exitOnError(err)
 
 	for bci.currentHash != nil {
 
-		block := bci.Next()
+		block, err := bci.Next()
+		exitOnError(err)
 
 		fmt.Printf("Prev hash: %x\n", block.PrevBlockHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
@@ -271,11 +697,9 @@ func (cli CLI) printChain(nodeID string) {
 	}
 }
 
-func (cli CLI) listAddresses(nodeID string) {
-	wallets, err := NewWallets(nodeID)
-	if err != nil {
-		log.Panic(err)
-	}
+func (cli CLI) listAddresses(dataDir DataDir, params *ChainParams) {
+	wallets, err := NewWallets(dataDir, params)
+	exitOnError(err)
 	addresses := wallets.GetAddresses()
 
 	for _, address := range addresses {
@@ -0,0 +1,129 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DataDirEnv is the environment variable overriding the default data directory
+const DataDirEnv = "BLOCKCHAIN_DATADIR"
+
+// DefaultNetwork is the network whose files are used unless another is chosen
+const DefaultNetwork = "main"
+
+const (
+	blockchainFileName = "blockchain.db"
+	walletFileName     = "wallet.dat"
+	mempoolFileName    = "mempool.dat"
+	peersFileName      = "peers.dat"
+	lockFileName       = "LOCK"
+)
+
+// ErrDataDirLocked is returned when another process is using a data directory
+var ErrDataDirLocked = errors.New("data directory is in use by another process")
+
+// DataDir locates the files of a node. Each network gets its own
+// subdirectory of Path holding the chain, wallet, mempool and peer files.
+type DataDir struct {
+	Path    string
+	Network string
+}
+
+// NewDataDir returns the DataDir of network under path. An empty path selects
+// the directory named by DataDirEnv, or DefaultDataDirPath(nodeID) if unset.
+func NewDataDir(path, network, nodeID string) DataDir {
+	if path == "" {
+		path = os.Getenv(DataDirEnv)
+	}
+
+	if path == "" {
+		path = DefaultDataDirPath(nodeID)
+	}
+
+	if network == "" {
+		network = DefaultNetwork
+	}
+
+	return DataDir{path, network}
+}
+
+// DefaultDataDirPath returns the default data directory of a node,
+// ~/.simple-blockchain, or ~/.simple-blockchain/<nodeID> for a node given an
+// ID. Nodes running on the same machine are told apart by their ID, as it is
+// also their port.
+func DefaultDataDirPath(nodeID string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+
+	return filepath.Join(home, ".simple-blockchain", nodeID)
+}
+
+// Dir returns the directory holding the files of the network
+func (d DataDir) Dir() string {
+	return filepath.Join(d.Path, d.Network)
+}
+
+// BlockchainFile returns the path of the chain database
+func (d DataDir) BlockchainFile() string {
+	return filepath.Join(d.Dir(), blockchainFileName)
+}
+
+// WalletFile returns the path of the wallet file
+func (d DataDir) WalletFile() string {
+	return filepath.Join(d.Dir(), walletFileName)
+}
+
+// MempoolFile returns the path the mempool is saved to
+func (d DataDir) MempoolFile() string {
+	return filepath.Join(d.Dir(), mempoolFileName)
+}
+
+// PeersFile returns the path the known peers are saved to
+func (d DataDir) PeersFile() string {
+	return filepath.Join(d.Dir(), peersFileName)
+}
+
+// Create creates the network directory if needed
+func (d DataDir) Create() error {
+	return os.MkdirAll(d.Dir(), 0700)
+}
+
+// Lock creates the network directory and takes its lock file, failing with
+// ErrDataDirLocked if another process holds it. The lock is released by
+// Unlock or when the process exits. A process must take it only once.
+func (d DataDir) Lock() (*DirLock, error) {
+	err := d.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := lockFile(filepath.Join(d.Dir(), lockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &DirLock{file}, nil
+}
+
+// DirLock is a lock held on a data directory
+type DirLock struct {
+	file *os.File
+}
+
+// Unlock releases the lock
+func (l *DirLock) Unlock() error {
+	return l.file.Close()
+}
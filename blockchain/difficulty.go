@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const minTargetBits = 1
+const maxTargetBits = 255
+
+// maxRetargetStep limits how many bits a single retarget can move the
+// difficulty, i.e. a factor of four either way
+const maxRetargetStep = 2
+
+// medianTimeSpan is the number of previous blocks whose median timestamp a
+// new block's timestamp must not precede
+const medianTimeSpan = 11
+
+// maxFutureBlockTime is how far ahead of the local clock a block may be
+const maxFutureBlockTime = 2 * time.Hour
+
+// nextBits returns the difficulty required of the block following parent
+func (bc *Blockchain) nextBits(parent *Block) (int, error) {
+	params := bc.Params
+	height := parent.Height + 1
+
+	if params.NoRetargeting || height%params.RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 1; i < params.RetargetInterval; i++ {
+		var err error
+		first, err = bc.parentOf(first)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	actual := parent.Timestamp - first.Timestamp
+	if actual < 1 {
+		actual = 1
+	}
+	expected := int64(params.RetargetInterval-1) * int64(params.TargetBlockTime/time.Second)
+
+	step := int(math.Round(math.Log2(float64(expected) / float64(actual))))
+	if step > maxRetargetStep {
+		step = maxRetargetStep
+	} else if step < -maxRetargetStep {
+		step = -maxRetargetStep
+	}
+
+	bits := parent.Bits + step
+	if bits < minTargetBits {
+		bits = minTargetBits
+	} else if bits > maxTargetBits {
+		bits = maxTargetBits
+	}
+
+	return bits, nil
+}
+
+// medianTime returns the median timestamp of the last medianTimeSpan blocks
+// ending at block
+func (bc *Blockchain) medianTime(block *Block) (int64, error) {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeSpan; i++ {
+		timestamps = append(timestamps, block.Timestamp)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+
+		var err error
+		block, err = bc.parentOf(block)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+// parentOf returns the block preceding block
+func (bc *Blockchain) parentOf(block *Block) (*Block, error) {
+	parent, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parent, nil
+}
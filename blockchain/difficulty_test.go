@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+// storeHeaders stores a block at each height up to the last one before a
+// retarget, spacing out their timestamps and giving them all the same bits.
+// The blocks hold no transactions, they are only read back as parents.
+func storeHeaders(t *testing.T, bc *Blockchain, spacing int64, bits int) []*Block {
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := []*Block{&genesis}
+	for height := 1; height < bc.Params.RetargetInterval; height++ {
+		parent := blocks[height-1]
+		block := &Block{
+			Timestamp:     genesis.Timestamp + int64(height)*spacing,
+			PrevBlockHash: parent.Hash,
+			Hash:          []byte{byte(spacing), byte(bits), byte(height)},
+			Height:        height,
+			Bits:          bits,
+		}
+		blocks = append(blocks, block)
+	}
+
+	err = bc.Db.Update(func(tx Tx) error {
+		for _, block := range blocks[1:] {
+			err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return blocks
+}
+
+func TestNextBits(t *testing.T) {
+	bc := newTestChain(t)
+	params := RegTestParams
+	params.NoRetargeting = false
+	bc.Params = &params
+
+	// Blocks are expected every second, so nine intervals take nine seconds
+	tests := []struct {
+		name       string
+		spacing    int64
+		bits, want int
+	}{
+		{"on time", 1, 8, 8},
+		{"twice as slow", 2, 8, 7},
+		{"four times as slow", 4, 8, 6},
+		{"slower than the step limit", 100, 8, 6},
+		{"faster than the step limit", 0, 8, 10},
+		{"easiest difficulty", 100, minTargetBits, minTargetBits},
+		{"hardest difficulty", 0, maxTargetBits, maxTargetBits},
+	}
+
+	for _, test := range tests {
+		blocks := storeHeaders(t, bc, test.spacing, test.bits)
+		parent := blocks[len(blocks)-1]
+
+		bits, err := bc.nextBits(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != test.want {
+			t.Errorf("%s: bits %d, want %d", test.name, bits, test.want)
+		}
+
+		// Only every RetargetInterval blocks is the difficulty changed
+		bits, err = bc.nextBits(blocks[len(blocks)-2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != test.bits {
+			t.Errorf("%s: bits %d between retargets, want %d", test.name, bits, test.bits)
+		}
+	}
+
+	params.NoRetargeting = true
+	blocks := storeHeaders(t, bc, 100, 8)
+	bits, err := bc.nextBits(blocks[len(blocks)-1])
+	if err != nil || bits != 8 {
+		t.Errorf("bits %d, %v without retargeting, want 8", bits, err)
+	}
+}
+
+func TestValidateBlockDifficulty(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, 1)
+	parent := blocks[0]
+
+	for _, bits := range []int{parent.Bits + 1, maxTargetBits + 1} {
+		cbTx, err := NewCoinbaseTX(address, "", 2, 0, bc.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Blocks of impossible difficulty are not mined, only claimed
+		block := &Block{Transactions: []*Transaction{cbTx}, PrevBlockHash: parent.Hash, Height: 2, Bits: bits}
+		if bits <= maxTargetBits {
+			block, err = NewBlock(block.Transactions, parent.Hash, 2, bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = bc.ValidateBlock(block)
+		if !errors.Is(err, ErrBadDifficulty) {
+			t.Errorf("bits %d: got %v, want %v", bits, err, ErrBadDifficulty)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package blockchain
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens path and takes an exclusive advisory lock on it
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,35 @@
+package blockchain
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is returned by CreateFile when another process has
+// the file open
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile opens path without sharing it, so that no other process can open
+// it until it is closed
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.CreateFile(name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0,
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0)
+	if err == errorSharingViolation {
+		return nil, ErrDataDirLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(handle), path), nil
+}
@@ -0,0 +1,262 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errStoreClosed is returned when using a MemoryStore after Close
+var errStoreClosed = errors.New("store is closed")
+
+// MemoryStore is a Store that keeps its buckets in memory, for throwaway
+// chains in tests and simulations. Like bbolt it allows one writer at a time,
+// but readers also wait for the writer to finish.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]*memBucket
+	closed  bool
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memBucket)}
+}
+
+// View runs fn in a read-only transaction
+func (s *MemoryStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return errStoreClosed
+	}
+
+	return fn(&memTx{store: s})
+}
+
+// Update runs fn in a read-write transaction. Changes are applied as they are
+// made and undone in reverse order if fn fails.
+func (s *MemoryStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStoreClosed
+	}
+
+	tx := &memTx{store: s, writable: true}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+// Close releases the data held by the store
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets = nil
+	s.closed = true
+
+	return nil
+}
+
+// memBucket holds a bucket's values and its keys in sorted order
+type memBucket struct {
+	values map[string][]byte
+	keys   []string
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{values: make(map[string][]byte)}
+}
+
+func (b *memBucket) set(key string, value []byte) {
+	if _, ok := b.values[key]; !ok {
+		i := sort.SearchStrings(b.keys, key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+
+	b.values[key] = value
+}
+
+func (b *memBucket) remove(key string) {
+	if _, ok := b.values[key]; !ok {
+		return
+	}
+
+	i := sort.SearchStrings(b.keys, key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.values, key)
+}
+
+// memTx is a MemoryStore transaction. Writable transactions record how to
+// undo each change.
+type memTx struct {
+	store    *MemoryStore
+	writable bool
+	undo     []func()
+}
+
+func (tx *memTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *memTx) Bucket(name []byte) Bucket {
+	b, ok := tx.store.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	return &memBucketTx{b, tx}
+}
+
+func (tx *memTx) CreateBucket(name []byte) (Bucket, error) {
+	if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+
+	if _, ok := tx.store.buckets[string(name)]; ok {
+		return nil, ErrBucketExists
+	}
+
+	b := newMemBucket()
+	tx.store.buckets[string(name)] = b
+	tx.undo = append(tx.undo, func() {
+		delete(tx.store.buckets, string(name))
+	})
+
+	return &memBucketTx{b, tx}, nil
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b := tx.Bucket(name); b != nil {
+		return b, nil
+	}
+
+	return tx.CreateBucket(name)
+}
+
+func (tx *memTx) DeleteBucket(name []byte) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	b, ok := tx.store.buckets[string(name)]
+	if !ok {
+		return ErrBucketNotFound
+	}
+
+	delete(tx.store.buckets, string(name))
+	tx.undo = append(tx.undo, func() {
+		tx.store.buckets[string(name)] = b
+	})
+
+	return nil
+}
+
+// memBucketTx is a bucket seen through a transaction
+type memBucketTx struct {
+	b  *memBucket
+	tx *memTx
+}
+
+func (b *memBucketTx) Get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b *memBucketTx) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	b.b.set(k, append([]byte{}, value...))
+
+	bucket := b.b
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			bucket.set(k, old)
+		} else {
+			bucket.remove(k)
+		}
+	})
+
+	return nil
+}
+
+func (b *memBucketTx) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	if !existed {
+		return nil
+	}
+	b.b.remove(k)
+
+	bucket := b.b
+	b.tx.undo = append(b.tx.undo, func() {
+		bucket.set(k, old)
+	})
+
+	return nil
+}
+
+func (b *memBucketTx) Cursor() Cursor {
+	return &memCursor{bucket: b.b}
+}
+
+// memCursor remembers its position by key, so that it keeps working when
+// the bucket is modified during iteration
+type memCursor struct {
+	bucket *memBucket
+	key    string
+	valid  bool
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if !c.valid {
+		return nil, nil
+	}
+
+	i := sort.SearchStrings(c.bucket.keys, c.key)
+	if i < len(c.bucket.keys) && c.bucket.keys[i] == c.key {
+		i++
+	}
+
+	return c.at(i)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.bucket.keys, string(seek)))
+}
+
+// at moves the cursor to the i-th key
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	if i >= len(c.bucket.keys) {
+		c.valid = false
+		return nil, nil
+	}
+
+	c.key = c.bucket.keys[i]
+	c.valid = true
+
+	return []byte(c.key), c.bucket.values[c.key]
+}
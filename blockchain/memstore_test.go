@@ -0,0 +1,188 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// bucketKeys returns the keys of the named bucket, in cursor order
+func bucketKeys(t *testing.T, s Store, name string) []string {
+	var keys []string
+
+	err := s.View(func(tx Tx) error {
+		c := tx.Bucket([]byte(name)).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestMemoryStoreRollback(t *testing.T) {
+	s := NewMemoryStore()
+
+	err := s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucket([]byte("kept"))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range []string{"a", "b", "c"} {
+			err = b.Put([]byte(key), []byte(key))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("failure")
+	err = s.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("kept"))
+
+		err := b.Put([]byte("a"), []byte("changed"))
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte("d"), []byte("d"))
+		if err != nil {
+			return err
+		}
+
+		err = b.Delete([]byte("b"))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte("created"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteBucket([]byte("kept"))
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+
+	err = s.View(func(tx Tx) error {
+		if tx.Bucket([]byte("created")) != nil {
+			return errors.New("bucket created by the failed update exists")
+		}
+
+		b := tx.Bucket([]byte("kept"))
+		if b == nil {
+			return errors.New("bucket deleted by the failed update is gone")
+		}
+
+		if v := b.Get([]byte("a")); string(v) != "a" {
+			return fmt.Errorf("value of a is %q, want %q", v, "a")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := fmt.Sprint(bucketKeys(t, s, "kept"))
+	if keys != "[a b c]" {
+		t.Errorf("keys after rollback %s, want [a b c]", keys)
+	}
+}
+
+func TestMemoryStoreViewNotWritable(t *testing.T) {
+	s := NewMemoryStore()
+
+	err := s.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("bucket"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.View(func(tx Tx) error {
+		return tx.Bucket([]byte("bucket")).Put([]byte("key"), []byte("value"))
+	})
+	if err != ErrTxNotWritable {
+		t.Errorf("got %v, want %v", err, ErrTxNotWritable)
+	}
+}
+
+func TestMemoryStoreCursorWithDeletes(t *testing.T) {
+	s := NewMemoryStore()
+
+	err := s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucket([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 10; i++ {
+			err = b.Put([]byte{byte(i)}, []byte{byte(i)})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the current key, and the one after every odd key, must not
+	// make the cursor skip or repeat keys
+	var visited []byte
+	err = s.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("bucket"))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			visited = append(visited, v[0])
+
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+
+			if k[0]%2 == 1 {
+				err = b.Delete([]byte{k[0] + 1})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(visited) != "[0 1 3 5 7 9]" {
+		t.Errorf("visited %v, want [0 1 3 5 7 9]", visited)
+	}
+
+	if keys := bucketKeys(t, s, "bucket"); len(keys) != 0 {
+		t.Errorf("keys %q left after deleting them all", keys)
+	}
+}
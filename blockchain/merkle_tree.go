@@ -35,12 +35,14 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &mNode
 }
 
-// NewMerkleTree creates a new merkle tree from a sequence of data
+// NewMerkleTree creates a new merkle tree from a sequence of data. A level
+// with an odd number of nodes pairs its last node with itself. The root of an
+// empty sequence is the hash of no data.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		return &MerkleTree{NewMerkleNode(nil, nil, nil)}
 	}
 
 	for _, datum := range data {
@@ -48,7 +50,11 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		var newLevel []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -57,6 +63,9 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		}
 
 		nodes = newLevel
+		if len(nodes) == 1 {
+			break
+		}
 	}
 
 	mTree := MerkleTree{&nodes[0]}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// merkleRoot computes the root NewMerkleTree should build over data,
+// hashing one level of plain byte slices at a time
+func merkleRoot(data [][]byte) []byte {
+	var level [][]byte
+	for _, datum := range data {
+		hash := sha256.Sum256(datum)
+		level = append(level, hash[:])
+	}
+
+	for {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+
+		level = next
+		if len(level) == 1 {
+			return level[0]
+		}
+	}
+}
+
+func TestMerkleTreeRoots(t *testing.T) {
+	// Roots of trees small enough for every level to be even once the
+	// leaves are, which blocks have always been hashed with
+	known := []string{
+		"b289dea92ca5aba5f2e1891a1af11be27914c48854db0fe5b4bb95c137e0f2d6",
+		"30e1867424e66e8b6d159246db94e3486778136f7e386ff5f001859d6b8484ab",
+		"f2dcdd96791b6bac5d554f2d320e594b834f5da1981812c3707e7772234cb0ad",
+		"9675e04b4ba9dc81b06e81731e2d21caa2c95557a85dcfa3fff70c9ff0f30b2e",
+	}
+
+	var data [][]byte
+	for n := 1; n <= 9; n++ {
+		data = append(data, []byte{byte(n - 1)})
+
+		root := NewMerkleTree(data).RootNode.Data
+		if !bytes.Equal(root, merkleRoot(data)) {
+			t.Errorf("%d leaves: root %x, want %x", n, root, merkleRoot(data))
+		}
+
+		if n <= len(known) && hex.EncodeToString(root) != known[n-1] {
+			t.Errorf("%d leaves: root %x changed from %s", n, root, known[n-1])
+		}
+	}
+}
+
+func TestHashTransactions(t *testing.T) {
+	_, address := newTestWallet(t)
+
+	var block Block
+	var data [][]byte
+	for n := 1; n <= 9; n++ {
+		tx, err := NewCoinbaseTX(address, "", n, 0, &RegTestParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Transactions = append(block.Transactions, tx)
+		data = append(data, tx.Serialize())
+
+		if !bytes.Equal(block.HashTransactions(), merkleRoot(data)) {
+			t.Errorf("%d transactions: wrong merkle root", n)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// saveGob writes v to path, replacing the file only once it is complete
+func saveGob(path string, v interface{}) error {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buff.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// loadGob reads v from path. A missing file leaves v untouched.
+func loadGob(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// savePeers saves the known nodes. Failures are only reported, the node
+// keeps running with its peers in memory.
+func savePeers() {
+	err := saveGob(dataDir.PeersFile(), knownNodes)
+	if err != nil {
+		fmt.Printf("Failed to save peers: %s\n", err)
+	}
+}
+
+// loadPeers adds the nodes saved by a previous run to the known nodes
+func loadPeers() error {
+	var peers []string
+
+	err := loadGob(dataDir.PeersFile(), &peers)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		if peer != nodeAddress && !nodeIsKnown(peer) {
+			knownNodes = append(knownNodes, peer)
+		}
+	}
+
+	return nil
+}
+
+// saveMempool saves the pending transactions. The caller must hold mempoolMu.
+func saveMempool() {
+	var txs []Transaction
+	for _, tx := range mempool {
+		txs = append(txs, tx)
+	}
+
+	err := saveGob(dataDir.MempoolFile(), txs)
+	if err != nil {
+		fmt.Printf("Failed to save mempool: %s\n", err)
+	}
+}
+
+// loadMempool restores the transactions saved by a previous run, dropping
+// those the chain no longer accepts
+func loadMempool(bc *Blockchain) error {
+	var txs []Transaction
+
+	err := loadGob(dataDir.MempoolFile(), &txs)
+	if err != nil {
+		return err
+	}
+
+	mempoolMu.Lock()
+	defer mempoolMu.Unlock()
+
+	for i := range txs {
+		tx := txs[i]
+
+		err = acceptToMempool(bc, &tx)
+		if err != nil {
+			fmt.Printf("Dropping saved transaction: %s\n", err)
+			continue
+		}
+		mempool[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	return nil
+}
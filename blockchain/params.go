@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"errors"
+	"time"
+)
+
+// ChainParams defines a network: its genesis block, reward, difficulty rules,
+// address format and how its nodes find and recognise each other
+type ChainParams struct {
+	Name string
+
+	// The genesis block is fixed so that every node of the network starts
+	// from the same block. GenesisNonce must solve it at GenesisBits.
+	GenesisCoinbaseData string
+	GenesisTimestamp    int64
+	GenesisNonce        int
+	GenesisBits         int
+
+	// Subsidy is the amount the first blocks' coinbases may create. It
+	// halves every HalvingInterval blocks.
+	Subsidy         int
+	HalvingInterval int
+	// MaxMoney bounds every amount: output values and the sums of the
+	// inputs or outputs of a transaction and of the fees or coinbase of a
+	// block. It is above MaxSupply, and keeps those sums from overflowing.
+	MaxMoney int
+	// CoinbaseMaturity is the number of blocks after which coinbase outputs
+	// can be spent, so that rewards a reorganization may take away are not
+	// passed on
+	CoinbaseMaturity int
+
+	// Difficulty is retargeted every RetargetInterval blocks so that, on
+	// average, a block is found every TargetBlockTime. With NoRetargeting
+	// every block keeps the genesis difficulty.
+	RetargetInterval int
+	TargetBlockTime  time.Duration
+	NoRetargeting    bool
+
+	// AddressVersion is the version byte prefixed to addresses
+	AddressVersion byte
+
+	// DefaultPort is the port a node listens on unless told otherwise
+	DefaultPort string
+	// Magic starts every message, so that nodes ignore other networks
+	Magic [4]byte
+	// SeedPeers are the nodes contacted on start. The first one is the
+	// central node, which relays transactions instead of mining them.
+	SeedPeers []string
+}
+
+// MainNetParams are the parameters of the main network
+var MainNetParams = ChainParams{
+	Name:                "main",
+	GenesisCoinbaseData: "I find your lack of faith disturbing",
+	GenesisTimestamp:    1577836800,
+	GenesisNonce:        1382960,
+	GenesisBits:         19,
+	Subsidy:             10,
+	HalvingInterval:     1000,
+	MaxMoney:            21000000,
+	CoinbaseMaturity:    100,
+	RetargetInterval:    10,
+	TargetBlockTime:     10 * time.Second,
+	AddressVersion:      0x00,
+	DefaultPort:         "3000",
+	Magic:               [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+	SeedPeers:           []string{"localhost:3000"},
+}
+
+// TestNetParams are the parameters of the test network, which is kept
+// separate from the main network but otherwise behaves the same
+var TestNetParams = ChainParams{
+	Name:                "test",
+	GenesisCoinbaseData: "These aren't the droids you're looking for",
+	GenesisTimestamp:    1577836860,
+	GenesisNonce:        149635,
+	GenesisBits:         16,
+	Subsidy:             10,
+	HalvingInterval:     1000,
+	MaxMoney:            21000000,
+	CoinbaseMaturity:    100,
+	RetargetInterval:    10,
+	TargetBlockTime:     10 * time.Second,
+	AddressVersion:      0x6f,
+	DefaultPort:         "13000",
+	Magic:               [4]byte{0x0b, 0x11, 0x09, 0x07},
+	SeedPeers:           []string{"localhost:13000"},
+}
+
+// RegTestParams are the parameters of the regression test network. Blocks
+// are mined almost instantly, which makes it suited to tests and CI.
+var RegTestParams = ChainParams{
+	Name:                "regtest",
+	GenesisCoinbaseData: "Do. Or do not. There is no try.",
+	GenesisTimestamp:    1577836920,
+	GenesisNonce:        1,
+	GenesisBits:         1,
+	Subsidy:             10,
+	HalvingInterval:     150,
+	MaxMoney:            21000000,
+	CoinbaseMaturity:    100,
+	RetargetInterval:    10,
+	TargetBlockTime:     time.Second,
+	NoRetargeting:       true,
+	AddressVersion:      0x6f,
+	DefaultPort:         "23000",
+	Magic:               [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	SeedPeers:           []string{"localhost:23000"},
+}
+
+// ErrUnknownNetwork is returned when looking up a network that is not defined
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// ParamsForNetwork returns the parameters of the named network
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+
+	return nil, ErrUnknownNetwork
+}
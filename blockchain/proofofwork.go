@@ -2,26 +2,57 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const targetBits = 19
+// MiningWorkers is the number of goroutines Run uses to search for a nonce
+var MiningWorkers = runtime.NumCPU()
+
+// ErrNonceSpaceExhausted is returned when no nonce satisfies the target
+var ErrNonceSpaceExhausted = errors.New("no valid nonce found")
+
+// nonceSize is the length of the nonce at the end of the header
+const nonceSize = 8
 
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
+	// targetBytes is target as a 32 byte big-endian number so that hashes
+	// can be compared without converting them
+	targetBytes [sha256.Size]byte
+	// header is the hashed data with the merkle root computed once; only
+	// its trailing nonce bytes change between attempts
+	header []byte
 }
 
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-b.Bits))
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{block: b, target: target}
+	targetBytes := target.Bytes()
+	copy(pow.targetBytes[sha256.Size-len(targetBytes):], targetBytes)
+	pow.header = bytes.Join(
+		[][]byte{
+			b.PrevBlockHash,
+			b.HashTransactions(),
+			IntToBytes(b.Timestamp),
+			IntToBytes(int64(b.Bits)),
+			make([]byte, nonceSize),
+		},
+		[]byte{},
+	)
 
 	return pow
 }
@@ -38,51 +69,126 @@ func IntToBytes(num int64) []byte {
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			IntToBytes(pow.block.Timestamp),
-			IntToBytes(int64(targetBits)),
-			IntToBytes(int64(nonce)),
-		},
-		[]byte{},
-	)
+	data := make([]byte, len(pow.header))
+	copy(data, pow.header)
+	putNonce(data, nonce)
 
 	return data
 }
 
-func (pow ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
-
-	fmt.Printf("Mining a new block")
-	for nonce < math.MaxInt64 {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
-		hashInt.SetBytes(hash[:])
-
-		if hashInt.Cmp(pow.target) == -1 {
-			break
-		} else {
-			nonce++
+// putNonce writes nonce into the trailing bytes of a header buffer
+func putNonce(header []byte, nonce int) {
+	binary.BigEndian.PutUint64(header[len(header)-nonceSize:], uint64(nonce))
+}
+
+// tryNonce writes nonce into data, a header buffer from prepareData, and
+// returns the resulting hash and whether it meets the target. It does not
+// allocate, so that the mining loop does not either.
+func (pow *ProofOfWork) tryNonce(data []byte, nonce int) ([sha256.Size]byte, bool) {
+	putNonce(data, nonce)
+	hash := sha256.Sum256(data)
+
+	return hash, pow.meetsTarget(&hash)
+}
+
+// meetsTarget reports whether hash is below the target
+func (pow *ProofOfWork) meetsTarget(hash *[sha256.Size]byte) bool {
+	return bytes.Compare(hash[:], pow.targetBytes[:]) < 0
+}
+
+// Run searches for a valid nonce using MiningWorkers goroutines
+func (pow ProofOfWork) Run() (int, []byte, error) {
+	return pow.RunContext(context.Background(), MiningWorkers)
+}
+
+// RunContext splits the nonce space between workers goroutines, worker i
+// trying nonces i, i+workers, i+2*workers and so on. It stops as soon as one
+// of them finds a valid nonce or ctx is cancelled.
+func (pow ProofOfWork) RunContext(ctx context.Context, workers int) (int, []byte, error) {
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashes uint64
+	var wg sync.WaitGroup
+	found := make(chan solution, workers)
+	start := time.Now()
+
+	fmt.Printf("Mining a new block with %d workers\n", workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(nonce int) {
+			defer wg.Done()
+			var tried uint64
+			data := pow.prepareData(nonce)
+
+			defer func() { atomic.AddUint64(&hashes, tried) }()
+
+			for ; nonce <= math.MaxInt64-workers; nonce += workers {
+				if tried%1024 == 0 && workCtx.Err() != nil {
+					return
+				}
+
+				hash, ok := pow.tryNonce(data, nonce)
+				tried++
+
+				if ok {
+					found <- solution{nonce, hash[:]}
+					return
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	result, ok := <-found
+	cancel()
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	total := atomic.LoadUint64(&hashes)
+	fmt.Printf("%d hashes in %s (%.0f H/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+
+	if !ok {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
 		}
+		return 0, nil, ErrNonceSpaceExhausted
 	}
-	fmt.Print("\n\n")
 
-	return nonce, hash[:]
+	return result.nonce, result.hash, nil
 }
 
-func (pow ProofOfWork) Validate() bool {
-	var hashInt big.Int
+// Work returns the expected number of hashes needed to satisfy the target
+func (pow ProofOfWork) Work() *big.Int {
+	maxTarget := new(big.Int).Lsh(big.NewInt(1), 256)
+	divisor := new(big.Int).Add(pow.target, big.NewInt(1))
+
+	return maxTarget.Div(maxTarget, divisor)
+}
+
+// Hash returns the hash of the block header with the block's nonce
+func (pow ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(pow.prepareData(pow.block.Nonce))
 
+	return hash[:]
+}
+
+func (pow ProofOfWork) Validate() bool {
 	data := pow.prepareData(pow.block.Nonce)
 	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
-
-	isValid := hashInt.Cmp(pow.target) == -1
 
-	return isValid
+	return pow.meetsTarget(&hash)
 }
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestTryNonceDoesNotAllocate(t *testing.T) {
+	pow := NewProofOfWork(GenesisBlock(&MainNetParams))
+	data := pow.prepareData(0)
+	nonce := 0
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		pow.tryNonce(data, nonce)
+		nonce++
+	})
+	if allocs != 0 {
+		t.Errorf("tryNonce allocates %v times per attempt, want 0", allocs)
+	}
+}
+
+func TestTryNonceMatchesHash(t *testing.T) {
+	block := GenesisBlock(&MainNetParams)
+	pow := NewProofOfWork(block)
+
+	hash, ok := pow.tryNonce(pow.prepareData(0), block.Nonce)
+	if !ok || !bytes.Equal(hash[:], block.Hash) {
+		t.Errorf("tryNonce(%d) = %x, %v, want %x, true", block.Nonce, hash, ok, block.Hash)
+	}
+}
+
+// BenchmarkProofOfWork measures the hashing loop of the miner, which
+// rewrites the nonce of a precomputed header
+func BenchmarkProofOfWork(b *testing.B) {
+	pow := NewProofOfWork(GenesisBlock(&MainNetParams))
+	data := pow.prepareData(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for nonce := 0; nonce < b.N; nonce++ {
+		pow.tryNonce(data, nonce)
+	}
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "H/s")
+}
+
+// BenchmarkProofOfWorkRebuildHeader measures the hashing loop as it was before
+// the header was precomputed: every attempt rebuilt the header, merkle root
+// included, and compared the hash as a big.Int
+func BenchmarkProofOfWorkRebuildHeader(b *testing.B) {
+	block := GenesisBlock(&MainNetParams)
+	pow := NewProofOfWork(block)
+	var hashInt big.Int
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for nonce := 0; nonce < b.N; nonce++ {
+		data := bytes.Join(
+			[][]byte{
+				block.PrevBlockHash,
+				block.HashTransactions(),
+				IntToBytes(block.Timestamp),
+				IntToBytes(int64(block.Bits)),
+				IntToBytes(int64(nonce)),
+			},
+			[]byte{},
+		)
+		hash := sha256.Sum256(data)
+		hashInt.SetBytes(hash[:])
+		hashInt.Cmp(pow.target)
+	}
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "H/s")
+}
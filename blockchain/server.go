@@ -2,19 +2,27 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"sync"
 )
 
+// verzion announces a node's chain. ChainWork is the cumulative work of its
+// active chain, which nodes sync towards; nodes predating it leave it unset
+// and are compared by height.
 type verzion struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	ChainWork  []byte
 }
 
 const protocol = "tcp"
@@ -23,42 +31,133 @@ const commandLength = 12
 
 var nodeAddress string
 var miningAddress string
-var knownNodes = []string{"localhost:3000"}
+var dataDir DataDir
+var chainParams = &MainNetParams
+var knownNodes []string
 var blocksInTransit = [][]byte{}
 var mempool = make(map[string]Transaction)
+var mempoolMu sync.Mutex
+
+var miningMu sync.Mutex
+var mining bool
+var cancelMining context.CancelFunc = func() {}
+
+// StartServer starts a node of the network of params listening on port, or
+// on the network's default port if port is empty. It uses the chain, mempool
+// and peers saved in the data directory, and only returns if the node cannot
+// be started or stops accepting connections.
+func StartServer(dir DataDir, params *ChainParams, port, minerAddress string) error {
+	if port == "" {
+		port = params.DefaultPort
+	}
 
-// StartServer starts a node
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	nodeAddress = fmt.Sprintf("localhost:%s", port)
 	fmt.Printf("Listening on: %s\n", nodeAddress)
 	miningAddress = minerAddress
+	dataDir = dir
+	chainParams = params
+	knownNodes = append([]string{}, params.SeedPeers...)
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	defer ln.Close()
 
-	bc := NewBlockchain(nodeID)
+	bc, err := NewBlockchain(dataDir, params)
+	if err == ErrChainNotFound {
+		fmt.Println("No blockchain found, starting from the genesis block")
+		bc, err = CreateBlockchain(dataDir, params)
+	}
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	err = loadPeers()
+	if err != nil {
+		return err
+	}
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	err = loadMempool(bc)
+	if err != nil {
+		return err
 	}
 
+	for _, node := range knownNodes {
+		if node != nodeAddress {
+			err = sendVersion(node, bc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	snapshotErr := make(chan error, 1)
+	go func() {
+		err := validateSnapshot(bc)
+		if err != nil {
+			snapshotErr <- err
+			ln.Close()
+		}
+	}()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Panic(err)
+			select {
+			case err = <-snapshotErr:
+			default:
+			}
+			return err
 		}
 		go handleConnection(conn, bc)
 	}
 }
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
+// validateSnapshot validates the history of a chain bootstrapped from a UTXO
+// snapshot while the node serves the chain built on top of it. A snapshot
+// that is not valid is reported and the node goes on with the chainstate
+// rebuilt from the blocks; only failing to check or repair the chain is an
+// error.
+func validateSnapshot(bc *Blockchain) error {
+	info, err := bc.GetSnapshotInfo()
+	if err != nil || info == nil || info.Validated {
+		return err
+	}
+
+	fmt.Printf("Validating the chain history up to the UTXO snapshot at height %d\n", info.Height)
+	err = bc.ValidateSnapshot()
+	var serr *SnapshotError
+	if errors.As(err, &serr) {
+		fmt.Printf("The UTXO snapshot is not valid: %s\n", err)
+		fmt.Println("The UTXO set was rebuilt from the blocks")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("The UTXO snapshot is valid")
+
+	return nil
+}
+
+func sendVersion(addr string, bc *Blockchain) error {
+	bestHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	work, err := bc.GetChainWork()
+	if err != nil {
+		return err
+	}
+	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress, work.Bytes()})
 
 	request := append(commandToBytes("version"), payload...)
-	sendData(addr, request)
+	sendData(addr, chainParams, request)
+
+	return nil
 }
 
 func gobEncode(data interface{}) []byte {
@@ -94,7 +193,21 @@ func bytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
-func sendData(addr string, data []byte) {
+// centralNode returns the first seed peer of the network of params, which
+// relays transactions to the miners, or "" if the network has no seed peers
+func centralNode(params *ChainParams) string {
+	if len(params.SeedPeers) == 0 {
+		return ""
+	}
+
+	return params.SeedPeers[0]
+}
+
+// sendData sends a request to addr, prefixed with the magic of the network of
+// params. An unreachable addr is dropped from the known nodes. The saved peers
+// are only rewritten by the node when it learns new ones, so that sending from
+// the CLI leaves the data directory alone.
+func sendData(addr string, params *ChainParams, data []byte) {
 	conn, err := net.Dial(protocol, addr)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
@@ -112,9 +225,9 @@ func sendData(addr string, data []byte) {
 	}
 	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	_, err = io.Copy(conn, bytes.NewReader(append(params.Magic[:], data...)))
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to send data to %s: %s\n", addr, err)
 	}
 }
 
@@ -134,7 +247,7 @@ func sendInv(address, kind string, items [][]byte) {
 	inventory := inv{nodeAddress, kind, items}
 	payload := gobEncode(inventory)
 	request := append(commandToBytes("inv"), payload...)
-	sendData(address, request)
+	sendData(address, chainParams, request)
 }
 
 type getblocks struct {
@@ -145,14 +258,14 @@ func sendGetBlocks(address string) {
 	payload := gobEncode(getblocks{nodeAddress})
 	request := append(commandToBytes("getblocks"), payload...)
 
-	sendData(address, request)
+	sendData(address, chainParams, request)
 }
 
 func sendGetData(address, kind string, id []byte) {
 	payload := gobEncode(getdata{nodeAddress, kind, id})
 	request := append(commandToBytes("getdata"), payload...)
 
-	sendData(address, request)
+	sendData(address, chainParams, request)
 }
 
 type block struct {
@@ -165,7 +278,7 @@ func sendBlock(addr string, b *Block) {
 	payload := gobEncode(data)
 	request := append(commandToBytes("block"), payload...)
 
-	sendData(addr, request)
+	sendData(addr, chainParams, request)
 }
 
 type tx struct {
@@ -173,12 +286,12 @@ type tx struct {
 	Transaction []byte
 }
 
-func sendTx(addr string, tnx *Transaction) {
+func sendTx(addr string, params *ChainParams, tnx *Transaction) {
 	data := tx{nodeAddress, tnx.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("tx"), payload...)
 
-	sendData(addr, request)
+	sendData(addr, params, request)
 }
 
 func nodeIsKnown(addr string) bool {
@@ -191,7 +304,7 @@ func nodeIsKnown(addr string) bool {
 	return false
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
+func handleGetBlocks(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload getblocks
 
@@ -199,13 +312,18 @@ func handleGetBlocks(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	blocks, err := bc.GetBlockHashes()
+	if err != nil {
+		return err
 	}
-	blocks := bc.GetBlockHashes()
 	sendInv(payload.AddrFrom, "block", blocks)
+
+	return nil
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+func handleVersion(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload verzion
 
@@ -213,24 +331,43 @@ func handleVersion(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	myBestHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-	if myBestHeight < foreignerBestHeight {
+	myWork, err := bc.GetChainWork()
+	if err != nil {
+		return err
+	}
+
+	// A chain with more work wins even if it is shorter
+	cmp := myWork.Cmp(new(big.Int).SetBytes(payload.ChainWork))
+	if payload.ChainWork == nil {
+		cmp = myBestHeight - payload.BestHeight
+	}
+
+	if cmp < 0 {
 		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	} else if cmp > 0 {
+		err = sendVersion(payload.AddrFrom, bc)
+		if err != nil {
+			return err
+		}
 	}
 
 	if !nodeIsKnown(payload.AddrFrom) {
 		knownNodes = append(knownNodes, payload.AddrFrom)
+		savePeers()
 	}
+
+	return nil
 }
 
-func handleInv(request []byte, bc *Blockchain) {
+func handleInv(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload inv
 
@@ -238,36 +375,52 @@ func handleInv(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit := payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+		// Inventories list the tip first, blocks are requested parents first
+		// so that each one can be connected as soon as it arrives.
+		blocksInTransit = [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			found, err := bc.HasBlock(payload.Items[i])
+			if err != nil {
+				return err
+			}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+			if !found {
+				blocksInTransit = append(blocksInTransit, payload.Items[i])
 			}
 		}
-		blocksInTransit = newInTransit
+
+		if len(blocksInTransit) == 0 {
+			return nil
+		}
+
+		blockHash := blocksInTransit[0]
+		sendGetData(payload.AddrFrom, "block", blockHash)
+
+		blocksInTransit = blocksInTransit[1:]
 	}
 
-	if payload.Type == "tx" {
+	if payload.Type == "tx" && len(payload.Items) > 0 {
 		txID := payload.Items[0]
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
+		mempoolMu.Lock()
+		_, known := mempool[hex.EncodeToString(txID)]
+		mempoolMu.Unlock()
+
+		if !known {
 			sendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
+
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
+func handleGetData(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload getdata
 
@@ -275,13 +428,13 @@ func handleGetData(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	if payload.Type == "block" {
 		block, err := bc.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return err
 		}
 
 		sendBlock(payload.AddrFrom, &block)
@@ -289,13 +442,21 @@ func handleGetData(request []byte, bc *Blockchain) {
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		mempoolMu.Lock()
+		tx, ok := mempool[txID]
+		mempoolMu.Unlock()
 
-		sendTx(payload.AddrFrom, &tx)
+		if !ok {
+			return ErrTransactionNotFound
+		}
+
+		sendTx(payload.AddrFrom, chainParams, &tx)
 	}
+
+	return nil
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
+func handleBlock(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload block
 
@@ -303,29 +464,58 @@ func handleBlock(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
+
+	oldTip, err := bc.Tip()
+	if err != nil {
+		return err
+	}
+
+	err = bc.AddBlock(block)
+	if errors.Is(err, ErrUnknownParent) {
+		fmt.Printf("Missing parent of block %x, requesting blocks\n", block.Hash)
+		sendGetBlocks(payload.AddrFrom)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
+	newTip, err := bc.Tip()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(oldTip, newTip) {
+		err = updateMempool(bc, oldTip, newTip)
+		if err != nil {
+			return err
+		}
+		stopMining()
+	}
+
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		sendGetData(payload.AddrFrom, "block", blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
 	}
+
+	return nil
 }
 
-func handleTx(request []byte, bc *Blockchain) {
+func handleTx(request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload tx
 
@@ -333,87 +523,260 @@ func handleTx(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
+
+	mempoolMu.Lock()
+	err = acceptToMempool(bc, &tx)
+	if err == nil {
+		mempool[hex.EncodeToString(tx.ID)] = tx
+		saveMempool()
+	}
+	pending := len(mempool)
+	mempoolMu.Unlock()
 
-	if nodeAddress == knownNodes[0] {
+	if err != nil {
+		return err
+	}
+
+	if nodeAddress == centralNode(chainParams) {
 		for _, node := range knownNodes {
 			if node != nodeAddress && node != payload.AddrFrom {
 				sendInv(node, "tx", [][]byte{tx.ID})
 			}
 		}
 	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+		if pending >= 2 && len(miningAddress) > 0 {
+			startMining(bc)
+		}
+	}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+	return nil
+}
+
+// startMining mines the transactions in the mempool in the background,
+// unless the miner is already running
+func startMining(bc *Blockchain) {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+
+	if mining {
+		return
+	}
+	mining = true
+
+	go mineTransactions(bc)
+}
+
+// stopMining abandons the block being mined so that the miner starts over
+// on the new tip
+func stopMining() {
+	miningMu.Lock()
+	cancelMining()
+	miningMu.Unlock()
+}
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+func mineTransactions(bc *Blockchain) {
+	defer func() {
+		miningMu.Lock()
+		mining = false
+		miningMu.Unlock()
+	}()
+
+	for {
+		var pending []*Transaction
+
+		mempoolMu.Lock()
+		if len(mempool) == 0 {
+			mempoolMu.Unlock()
+			return
+		}
+		for id := range mempool {
+			tx := mempool[id]
+			pending = append(pending, &tx)
+		}
+		mempoolMu.Unlock()
+
+		txs, fees, height, err := bc.selectTransactions(pending)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if len(txs) == 0 {
+			fmt.Println("All transactions are invalid! Waiting for new ones...")
+			return
+		}
+
+		cbTx, err := NewCoinbaseTX(miningAddress, "", height+1, fees, bc.Params)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		txs = append(txs, cbTx)
+
+		miningMu.Lock()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelMining = cancel
+		miningMu.Unlock()
+
+		newBlock, err := bc.MineBlockContext(ctx, txs)
+		cancel()
+
+		// The coinbase encodes the height selectTransactions saw, which is
+		// wrong if the tip moved before mining started
+		if err == context.Canceled || err == ErrStaleTip || errors.Is(err, ErrBadCoinbaseHeight) {
+			fmt.Println("Chain tip changed, restarting mining")
+			continue
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+		fmt.Println("New block is mined!")
 
-			fmt.Println("New block is mined!")
+		removeFromMempool(txs)
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
+		for _, node := range knownNodes {
+			if node != nodeAddress {
+				sendInv(node, "block", [][]byte{newBlock.Hash})
 			}
+		}
+	}
+}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
+// removeFromMempool drops transactions that made it into a block
+func removeFromMempool(txs []*Transaction) {
+	mempoolMu.Lock()
+	defer mempoolMu.Unlock()
+
+	for _, tx := range txs {
+		delete(mempool, hex.EncodeToString(tx.ID))
+	}
+	saveMempool()
+}
+
+// updateMempool brings the mempool in line with the active chain after its
+// tip moved from oldTip to newTip. The transactions of blocks that left the
+// active chain return to the mempool, and every transaction is checked
+// again, which drops those the new blocks include or conflict with.
+func updateMempool(bc *Blockchain, oldTip, newTip []byte) error {
+	var detached []*Block
+
+	err := bc.Db.View(func(tx Tx) error {
+		var err error
+		detached, _, err = findFork(tx.Bucket([]byte(blocksBucket)), oldTip, newTip)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	mempoolMu.Lock()
+	defer mempoolMu.Unlock()
+
+	// findFork lists the detached blocks tip first
+	var pending []Transaction
+	for i := len(detached) - 1; i >= 0; i-- {
+		for _, tx := range detached[i].Transactions {
+			if !tx.IsCoinbase() {
+				pending = append(pending, *tx)
 			}
+		}
+	}
+	for _, tx := range mempool {
+		pending = append(pending, tx)
+	}
+
+	mempool = make(map[string]Transaction)
+	for i := range pending {
+		tx := pending[i]
 
-			if len(mempool) > 0 {
-				goto MineTransactions
+		if acceptToMempool(bc, &tx) == nil {
+			mempool[hex.EncodeToString(tx.ID)] = tx
+		}
+	}
+	saveMempool()
+
+	return nil
+}
+
+// acceptToMempool checks tx against the active chain and against the
+// transactions already waiting in the mempool
+func acceptToMempool(bc *Blockchain, tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return &TxError{tx.ID, ErrLooseCoinbase}
+	}
+
+	if _, ok := mempool[hex.EncodeToString(tx.ID)]; ok {
+		return &TxError{tx.ID, ErrTxInMempool}
+	}
+
+	for _, pending := range mempool {
+		for _, pendingIn := range pending.Vin {
+			for _, vin := range tx.Vin {
+				if bytes.Equal(pendingIn.Txid, vin.Txid) && pendingIn.Vout == vin.Vout {
+					return &TxError{tx.ID, ErrSpentInput}
+				}
 			}
 		}
 	}
+
+	return bc.VerifyTransaction(tx)
 }
 
+// handleConnection reads a request and dispatches it to its handler. Errors
+// are only logged, a bad request must not bring the node down.
 func handleConnection(conn net.Conn, bc *Blockchain) {
+	defer conn.Close()
+
 	req, err := ioutil.ReadAll(conn)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to read request: %s\n", err)
+		return
+	}
+
+	magic := chainParams.Magic[:]
+	if !bytes.HasPrefix(req, magic) {
+		fmt.Println("Ignoring a request from another network")
+		return
 	}
+	req = req[len(magic):]
+
+	if len(req) < commandLength {
+		fmt.Println("Received a truncated request")
+		return
+	}
+
 	command := bytesToCommand(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
 	switch command {
 	case "version":
-		handleVersion(req, bc)
+		err = handleVersion(req, bc)
 	case "tx":
-		handleTx(req, bc)
+		err = handleTx(req, bc)
 	case "block":
-		handleBlock(req, bc)
+		err = handleBlock(req, bc)
 	case "getblocks":
-		handleGetBlocks(req, bc)
+		err = handleGetBlocks(req, bc)
 	case "getdata":
-		handleGetData(req, bc)
+		err = handleGetData(req, bc)
 	case "inv":
-		handleInv(req, bc)
+		err = handleInv(req, bc)
 	default:
 		fmt.Println("Unknown command!")
 	}
 
-	conn.Close()
+	if err != nil {
+		fmt.Printf("Failed to handle %s command: %s\n", command, err)
+	}
 }
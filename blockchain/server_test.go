@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUpdateMempoolAfterReorg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc := newTestChain(t)
+	savedDir, savedMempool := dataDir, mempool
+	dataDir, mempool = DataDir{dir, bc.Params.Name}, make(map[string]Transaction)
+	defer func() {
+		dataDir, mempool = savedDir, savedMempool
+	}()
+	err = dataDir.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+3)
+	coinbases := []*Transaction{blocks[0].Transactions[0], blocks[1].Transactions[0], blocks[2].Transactions[0]}
+	fork := blocks[len(blocks)-1]
+
+	mined := newTestSpend(t, wallet, coinbases[0], 0, other, coinbases[0].Vout[0].Value)
+	cbTx, err := NewCoinbaseTX(address, "", fork.Height+1, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTip, err := bc.MineBlock([]*Transaction{cbTx, mined})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := newTestSpend(t, wallet, coinbases[1], 0, other, coinbases[1].Vout[0].Value)
+	conflicting := newTestSpend(t, wallet, coinbases[2], 0, other, coinbases[2].Vout[0].Value)
+	mempool[hex.EncodeToString(waiting.ID)] = *waiting
+	mempool[hex.EncodeToString(conflicting.ID)] = *conflicting
+
+	// The side branch spends the output the conflicting transaction spends,
+	// and overtakes the block holding the mined one
+	parent := fork
+	for i := 0; i < 2; i++ {
+		cbTx, err := NewCoinbaseTX(other, "", parent.Height+1, 0, bc.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs := []*Transaction{cbTx}
+		if i == 0 {
+			txs = append(txs, newTestSpend(t, wallet, coinbases[2], 0, address, coinbases[2].Vout[0].Value))
+		}
+
+		parent, err = NewBlock(txs, parent.Hash, parent.Height+1, parent.Bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.AddBlock(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = updateMempool(bc, oldTip.Hash, parent.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mempool) != 2 {
+		t.Errorf("mempool holds %d transactions, want 2", len(mempool))
+	}
+	for name, tx := range map[string]*Transaction{"detached": mined, "waiting": waiting} {
+		if _, ok := mempool[hex.EncodeToString(tx.ID)]; !ok {
+			t.Errorf("%s transaction missing from the mempool", name)
+		}
+	}
+	if _, ok := mempool[hex.EncodeToString(conflicting.ID)]; ok {
+		t.Error("transaction conflicting with the new chain kept in the mempool")
+	}
+}
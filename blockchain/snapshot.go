@@ -0,0 +1,621 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// snapshotMagic starts every UTXO snapshot, ahead of its version and the
+// magic of the network it belongs to
+var snapshotMagic = []byte("SBCU")
+
+const snapshotVersion = 2
+
+// maxSnapshotField bounds the length of a key or public key hash read from a
+// snapshot, so that a corrupt length does not exhaust memory
+const maxSnapshotField = 1 << 10
+
+// snapshotKey records in the meta bucket the UTXO snapshot the chain was
+// bootstrapped from
+var snapshotKey = []byte("snapshot")
+
+// Reasons a UTXO snapshot can be rejected
+var (
+	ErrNotSnapshotFile    = errors.New("not a UTXO snapshot")
+	ErrSnapshotVersion    = errors.New("unsupported UTXO snapshot version")
+	ErrSnapshotNetwork    = errors.New("UTXO snapshot belongs to another network")
+	ErrSnapshotCommitment = errors.New("UTXO snapshot does not match its commitment")
+	ErrSnapshotTip        = errors.New("blocks do not lead to the tip of the UTXO snapshot")
+	ErrSnapshotChain      = errors.New("a UTXO snapshot can only be loaded into a chain holding just the genesis block")
+	ErrSnapshotInvalid    = errors.New("chain history does not produce the UTXO snapshot")
+)
+
+// SnapshotError reports a UTXO snapshot whose chain history failed
+// validation. The blocks of the active chain up to Height are valid.
+type SnapshotError struct {
+	Height int
+	Err    error
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("UTXO snapshot rejected, the chain is valid up to height %d: %s", e.Height, e.Err)
+}
+
+// Unwrap returns the reason the snapshot was rejected
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+// SnapshotInfo describes a UTXO snapshot: the block it was taken at and the
+// SHA-256 commitment to its entries. Validated is set once the chain history
+// up to the block has been checked to produce the snapshot.
+type SnapshotInfo struct {
+	Hash       []byte
+	Height     int
+	Commitment []byte
+	Validated  bool
+}
+
+// snapshotEntry is a chainstate entry read from a snapshot
+type snapshotEntry struct {
+	Key   []byte
+	Entry UTXOEntry
+}
+
+// writeSnapshotEntry writes a chainstate entry in the snapshot encoding: the
+// outpoint key, the height and coinbase flag of the output's transaction,
+// then the output's value and public key hash. Unlike gob, the encoding does
+// not depend on the process writing it, so the commitment can be recomputed
+// anywhere.
+func writeSnapshotEntry(w io.Writer, key []byte, entry UTXOEntry) error {
+	var buf bytes.Buffer
+
+	writeSnapshotBytes(&buf, key)
+	writeSnapshotUint(&buf, uint64(entry.Height))
+	if entry.Coinbase {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	writeSnapshotUint(&buf, uint64(entry.Output.Value))
+	writeSnapshotBytes(&buf, entry.Output.PubKeyHash)
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+func writeSnapshotUint(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeSnapshotBytes(buf *bytes.Buffer, data []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	buf.Write(b[:])
+	buf.Write(data)
+}
+
+// readSnapshotEntry reads an entry written by writeSnapshotEntry
+func readSnapshotEntry(r io.Reader) (snapshotEntry, error) {
+	var entry snapshotEntry
+
+	key, err := readSnapshotBytes(r)
+	if err != nil {
+		return entry, err
+	}
+
+	if len(key) != outpointSize {
+		return entry, ErrNotSnapshotFile
+	}
+
+	height, err := readSnapshotUint(r)
+	if err != nil {
+		return entry, err
+	}
+
+	var coinbase [1]byte
+	_, err = io.ReadFull(r, coinbase[:])
+	if err != nil {
+		return entry, err
+	}
+
+	value, err := readSnapshotUint(r)
+	if err != nil {
+		return entry, err
+	}
+
+	pubKeyHash, err := readSnapshotBytes(r)
+	if err != nil {
+		return entry, err
+	}
+
+	output := TXOutput{int(value), pubKeyHash}
+
+	return snapshotEntry{key, UTXOEntry{output, int(height), coinbase[0] == 1}}, nil
+}
+
+func readSnapshotUint(r io.Reader) (uint64, error) {
+	var b [8]byte
+	_, err := io.ReadFull(r, b[:])
+
+	return binary.BigEndian.Uint64(b[:]), err
+}
+
+func readSnapshotBytes(r io.Reader) ([]byte, error) {
+	var b [4]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(b[:])
+	if size > maxSnapshotField {
+		return nil, ErrNotSnapshotFile
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+
+	return data, err
+}
+
+// Dump writes the UTXO set to w as a snapshot. The snapshot starts with
+// snapshotMagic, the format version, the network magic, the hash and height
+// of the tip the set ends at and the number of entries. The entries follow
+// in key order, and the SHA-256 of the entries, the commitment, ends the
+// snapshot. It returns a description of the snapshot.
+func (u UTXOSet) Dump(w io.Writer) (*SnapshotInfo, error) {
+	var info SnapshotInfo
+	params := u.Blockchain.Params
+
+	err := u.Blockchain.Db.View(func(tx Tx) error {
+		tip, err := getTipInfo(tx)
+		if err != nil {
+			return err
+		}
+
+		if !utxoInSync(tx, tip.Hash) {
+			return ErrUTXOMismatch
+		}
+
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		count := 0
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			count++
+		}
+
+		bw := bufio.NewWriter(w)
+		var header bytes.Buffer
+		var version [4]byte
+		binary.BigEndian.PutUint32(version[:], snapshotVersion)
+		header.Write(snapshotMagic)
+		header.Write(version[:])
+		header.Write(params.Magic[:])
+		writeSnapshotBytes(&header, tip.Hash)
+		writeSnapshotUint(&header, uint64(tip.Height))
+		writeSnapshotUint(&header, uint64(count))
+
+		_, err = bw.Write(header.Bytes())
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		entries := io.MultiWriter(bw, hash)
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
+
+			err = writeSnapshotEntry(entries, k, entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		commitment := hash.Sum(nil)
+		_, err = bw.Write(commitment)
+		if err != nil {
+			return err
+		}
+
+		info = SnapshotInfo{append([]byte{}, tip.Hash...), tip.Height, commitment, false}
+
+		return bw.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// readSnapshot reads and checks a snapshot of the network of params
+func readSnapshot(r io.Reader, params *ChainParams) (*SnapshotInfo, []snapshotEntry, error) {
+	var info SnapshotInfo
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+4+len(params.Magic))
+	_, err := io.ReadFull(br, header)
+	if err != nil || !bytes.HasPrefix(header, snapshotMagic) {
+		return nil, nil, ErrNotSnapshotFile
+	}
+
+	if binary.BigEndian.Uint32(header[len(snapshotMagic):]) != snapshotVersion {
+		return nil, nil, ErrSnapshotVersion
+	}
+
+	if !bytes.Equal(header[len(snapshotMagic)+4:], params.Magic[:]) {
+		return nil, nil, ErrSnapshotNetwork
+	}
+
+	info.Hash, err = readSnapshotBytes(br)
+	if err != nil {
+		return nil, nil, ErrNotSnapshotFile
+	}
+
+	height, err := readSnapshotUint(br)
+	if err != nil {
+		return nil, nil, ErrNotSnapshotFile
+	}
+	info.Height = int(height)
+
+	count, err := readSnapshotUint(br)
+	if err != nil {
+		return nil, nil, ErrNotSnapshotFile
+	}
+
+	var entries []snapshotEntry
+	hash := sha256.New()
+	tee := io.TeeReader(br, hash)
+
+	for i := uint64(0); i < count; i++ {
+		entry, err := readSnapshotEntry(tee)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	info.Commitment = hash.Sum(nil)
+	commitment := make([]byte, sha256.Size)
+	_, err = io.ReadFull(br, commitment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(commitment, info.Commitment) {
+		return nil, nil, ErrSnapshotCommitment
+	}
+
+	return &info, entries, nil
+}
+
+// utxoCommitment returns the commitment of a snapshot holding UTXO
+func utxoCommitment(UTXO map[string]UTXOEntry) ([]byte, error) {
+	var keys []string
+	for key := range UTXO {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		outpoint, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeSnapshotEntry(hash, outpoint, UTXO[key])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// GetSnapshotInfo returns the snapshot the chain was bootstrapped from, or
+// nil if it was not
+func (bc *Blockchain) GetSnapshotInfo() (*SnapshotInfo, error) {
+	var info *SnapshotInfo
+
+	err := bc.Db.View(func(tx Tx) error {
+		data := tx.Bucket([]byte(metaBucket)).Get(snapshotKey)
+		if data == nil {
+			return nil
+		}
+
+		info = &SnapshotInfo{}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(info)
+	})
+
+	return info, err
+}
+
+// putSnapshotInfo records the snapshot the chain was bootstrapped from
+func putSnapshotInfo(tx Tx, info *SnapshotInfo) error {
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(info)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(metaBucket)).Put(snapshotKey, buff.Bytes())
+}
+
+// LoadUTXOSnapshot bootstraps a chain holding only the genesis block from a
+// UTXO snapshot and a bootstrap file holding the blocks up to the snapshot's
+// tip. The headers of the blocks are checked, but their transactions are not
+// replayed; ValidateSnapshot does that later. A load that was interrupted
+// resumes when the same snapshot is loaded again.
+func (bc *Blockchain) LoadUTXOSnapshot(snapshot, blocks io.Reader) (*SnapshotInfo, error) {
+	info, entries, err := readSnapshot(snapshot, bc.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	loading, err := bc.GetSnapshotInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	resuming := loading != nil && bytes.Equal(loading.Hash, info.Hash) && !loading.Validated && height <= info.Height
+	if height > 0 && !resuming {
+		return nil, ErrSnapshotChain
+	}
+
+	err = bc.Db.Update(func(tx Tx) error {
+		return putSnapshotInfo(tx, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = bc.importHeaders(blocks, info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bc.Db.Update(func(tx Tx) error {
+		for _, name := range utxoBuckets {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+		}
+
+		err := createUTXOBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			err = putUTXO(tx, entry.Key, entry.Entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte(metaBucket)).Put(utxoTipKey, info.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// importHeaders stores the blocks of a bootstrap file up to the tip of the
+// snapshot and makes them the active chain, checking their headers only.
+// The UTXO set is left untouched.
+func (bc *Blockchain) importHeaders(r io.Reader, info *SnapshotInfo) error {
+	br, err := newBootstrapReader(r, bc.Params)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	var prevHash []byte
+
+	for {
+		block, err := br.next(bc.Params)
+		if err == io.EOF {
+			return ErrSnapshotTip
+		}
+		if err != nil {
+			return err
+		}
+
+		found, err := bc.HasBlock(block.Hash)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			_, err = bc.verifyBlock(block, block.Hash, prevHash, nil, VerifyHeaders)
+			if err != nil {
+				return &BlockError{block.Hash, err}
+			}
+
+			err = bc.Db.Update(func(tx Tx) error {
+				err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+				if err != nil {
+					return err
+				}
+
+				err = putChainWork(tx, block)
+				if err != nil {
+					return err
+				}
+
+				return indexBlock(tx, block)
+			})
+			if err != nil {
+				return err
+			}
+
+			if block.Height%bootstrapProgressInterval == 0 {
+				fmt.Printf("Stored blocks up to height %d\n", block.Height)
+			}
+		}
+
+		if block.Height == info.Height {
+			if !bytes.Equal(block.Hash, info.Hash) {
+				return ErrSnapshotTip
+			}
+
+			return nil
+		}
+
+		prevHash = block.Hash
+	}
+}
+
+// ValidateSnapshot checks the chain history behind the UTXO snapshot the
+// chain was bootstrapped from: every block up to the snapshot's tip is fully
+// validated, and the UTXO set they produce has to match the snapshot's
+// commitment. The undo records the load could not write are written as the
+// blocks are replayed, and the snapshot is then marked as validated. If the
+// history does not produce the snapshot, the snapshot is rejected and a
+// SnapshotError is returned once the chain is repaired. It does nothing if
+// the chain was not bootstrapped from a snapshot or it was validated.
+func (bc *Blockchain) ValidateSnapshot() error {
+	info, err := bc.GetSnapshotInfo()
+	if err != nil || info == nil || info.Validated {
+		return err
+	}
+
+	var UTXO map[string]UTXOEntry
+
+	hash, err := bc.verifyRange(0, info.Height, VerifyTransactions, func(block *Block, undo blockUndo, view *utxoView) error {
+		if block.Height == info.Height {
+			UTXO = make(map[string]UTXOEntry, len(view.entries))
+			for key, entry := range view.entries {
+				UTXO[key] = *entry
+			}
+		}
+
+		return bc.Db.Update(func(tx Tx) error {
+			return tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+		})
+	})
+
+	var verr *VerifyError
+	if errors.As(err, &verr) {
+		return bc.rejectSnapshot(info, &SnapshotError{verr.Height - 1, verr})
+	}
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hash, info.Hash) {
+		return bc.rejectSnapshot(info, &SnapshotError{info.Height, ErrSnapshotTip})
+	}
+
+	commitment, err := utxoCommitment(UTXO)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(commitment, info.Commitment) {
+		return bc.rejectSnapshot(info, &SnapshotError{info.Height, ErrSnapshotInvalid})
+	}
+
+	info.Validated = true
+
+	return bc.Db.Update(func(tx Tx) error {
+		return putSnapshotInfo(tx, info)
+	})
+}
+
+// rejectSnapshot drops the record of a snapshot whose history failed
+// validation and rebuilds the chainstate from the blocks of the active chain.
+// The blocks above serr.Height up to the snapshot's tip are invalid, and the
+// ones above the tip were only checked against the snapshot's entries, so the
+// first of them whose transactions do not check is removed with every block
+// after it. It returns serr once the chain is repaired.
+func (bc *Blockchain) rejectSnapshot(info *SnapshotInfo, serr *SnapshotError) error {
+	removed, from := 0, 0
+
+	err := bc.Db.Update(func(tx Tx) error {
+		for _, name := range utxoBuckets {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+		}
+
+		err := createUTXOBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		tip, err := getTipInfo(tx)
+		if err != nil {
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightsBucket))
+
+		for height := 0; height <= tip.Height; height++ {
+			block, err := loadBlock(blocks, heights.Get(heightKey(height)))
+			if err != nil {
+				return err
+			}
+
+			if height > serr.Height {
+				valid := height > info.Height
+				if valid {
+					view := newUTXOView(tx.Bucket([]byte(utxoBucket)), height, bc.Params)
+					_, err = bc.checkBlockTransactions(block, view)
+					valid = err == nil
+				}
+
+				if !valid {
+					removed, from = tip.Height+1-height, height
+					err = truncateChain(tx, height, tip.Height)
+					if err != nil {
+						return err
+					}
+					break
+				}
+			}
+
+			err = connectUTXO(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte(metaBucket)).Delete(snapshotKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		fmt.Printf("Removed %d invalid blocks from height %d\n", removed, from)
+	}
+
+	return serr
+}
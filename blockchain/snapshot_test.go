@@ -0,0 +1,212 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// takeSnapshot dumps the UTXO set of bc and exports its blocks
+func takeSnapshot(t *testing.T, bc *Blockchain) (*bytes.Buffer, *bytes.Buffer) {
+	var snapshot, blocks bytes.Buffer
+
+	_, err := UTXOSet{bc}.Dump(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bc.ExportChain(&blocks, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &snapshot, &blocks
+}
+
+// loadSnapshot bootstraps a new chain from a snapshot and its blocks
+func loadSnapshot(t *testing.T, snapshot, blocks *bytes.Buffer) *Blockchain {
+	bc := newTestChain(t)
+
+	_, err := bc.LoadUTXOSnapshot(bytes.NewReader(snapshot.Bytes()), bytes.NewReader(blocks.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bc
+}
+
+// checkRejected checks that the snapshot of bc was rejected with err, that
+// the chain was cut down to height and that its chainstate matches its blocks
+func checkRejected(t *testing.T, bc *Blockchain, err, want error, height int) {
+	var serr *SnapshotError
+	if !errors.As(err, &serr) || !errors.Is(err, want) {
+		t.Fatalf("got %v, want a SnapshotError for %v", err, want)
+	}
+
+	info, err := bc.GetSnapshotInfo()
+	if err != nil || info != nil {
+		t.Errorf("snapshot record %v, %v after rejection", info, err)
+	}
+
+	best, err := bc.GetBestHeight()
+	if err != nil || best != height {
+		t.Errorf("tip at height %d, %v, want %d", best, err, height)
+	}
+
+	err = bc.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Errorf("chain after rejection: %v", err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+
+	tx, err := NewUTXOTransaction(wallet, other, 3, 1, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbTx, err := NewCoinbaseTX(address, "", height+1, 1, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock([]*Transaction{cbTx, tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, blocks := takeSnapshot(t, bc)
+	loaded := loadSnapshot(t, snapshot, blocks)
+
+	err = loaded.ValidateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := loaded.GetSnapshotInfo()
+	if err != nil || info == nil || !info.Validated {
+		t.Fatalf("snapshot record %v, %v, want a validated one", info, err)
+	}
+
+	again, _ := takeSnapshot(t, loaded)
+	if !bytes.Equal(again.Bytes(), snapshot.Bytes()) {
+		t.Error("snapshot of the loaded chain differs from the original")
+	}
+
+	err = loaded.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tip, err := loaded.GetBlockByHeight(height + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UTXOSet{loaded}.Disconnect(&tip)
+	if err != nil {
+		t.Errorf("disconnecting the snapshot tip: %v", err)
+	}
+}
+
+func TestSnapshotForged(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	mineBlocks(t, bc, address, 3)
+
+	forgedID := make([]byte, 32)
+	forged := *NewTXOutput(1000, address)
+	err := bc.Db.Update(func(tx Tx) error {
+		return putUTXO(tx, outpointKey(forgedID, 7), UTXOEntry{forged, 1, false})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, blocks := takeSnapshot(t, bc)
+	loaded := loadSnapshot(t, snapshot, blocks)
+
+	// A block above the snapshot spending the forged output is only valid
+	// against the snapshot, and has to go with it
+	tx := newTestTX([]TXInput{{forgedID, 7, nil, wallet.PublicKey}}, []TXOutput{*NewTXOutput(1000, other)})
+	err = tx.Sign(wallet.PrivateKet, map[string]TXOutput{outpointID(forgedID, 7): forged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	cbTx, err := NewCoinbaseTX(address, "", 4, 0, loaded.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loaded.MineBlock([]*Transaction{cbTx, tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, loaded, address, 1)
+
+	err = loaded.ValidateSnapshot()
+	checkRejected(t, loaded, err, ErrSnapshotInvalid, 3)
+}
+
+func TestSnapshotInvalidBlock(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	mineBlocks(t, bc, address, 1)
+
+	// The chain the snapshot is taken from holds a block whose coinbase
+	// claims too much, stored without validation
+	tip, err := bc.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbTx, err := NewCoinbaseTX(address, "", 2, 1000, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := NewBlock([]*Transaction{cbTx}, tip.Hash, 2, tip.Bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.Db.Update(func(tx Tx) error {
+		err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+
+		err = putChainWork(tx, block)
+		if err != nil {
+			return err
+		}
+
+		return connectBlock(tx, block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, address, 2)
+
+	snapshot, blocks := takeSnapshot(t, bc)
+	loaded := loadSnapshot(t, snapshot, blocks)
+
+	err = loaded.ValidateSnapshot()
+	checkRejected(t, loaded, err, ErrBadCoinbaseValue, 1)
+
+	for height := 2; height <= 4; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := loaded.HasBlock(block.Hash)
+		if err != nil || found {
+			t.Errorf("invalid block at height %d still stored: %v", height, err)
+		}
+	}
+}
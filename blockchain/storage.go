@@ -0,0 +1,50 @@
+package blockchain
+
+import "errors"
+
+// Store is the transactional key-value storage the chain is kept in. Data is
+// grouped in named buckets holding keys in byte order, the model of bbolt,
+// which is the default implementation. MemoryStore keeps everything in memory.
+type Store interface {
+	// View runs fn in a read-only transaction
+	View(fn func(Tx) error) error
+	// Update runs fn in a read-write transaction, which is committed if fn
+	// returns nil and rolled back otherwise
+	Update(fn func(Tx) error) error
+	Close() error
+}
+
+// Tx is a transaction of a Store
+type Tx interface {
+	// Bucket returns the named bucket, or nil if it does not exist
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Bucket is a collection of key/value pairs. Values returned by Get and by
+// cursors are only valid for the life of the transaction.
+type Bucket interface {
+	// Get returns the value of key, or nil if it is not set
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() Cursor
+}
+
+// Cursor iterates over the keys of a bucket in byte order. The methods
+// return a nil key once the end of the bucket is reached.
+type Cursor interface {
+	First() (key, value []byte)
+	Next() (key, value []byte)
+	// Seek moves to the first key greater than or equal to seek
+	Seek(seek []byte) (key, value []byte)
+}
+
+// Errors returned by Store implementations
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrTxNotWritable  = errors.New("transaction is not writable")
+)
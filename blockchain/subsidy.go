@@ -0,0 +1,49 @@
+package blockchain
+
+// maxHalvings is the number of halvings after which the subsidy is zero
+// whatever its initial value
+const maxHalvings = 64
+
+// BlockSubsidy returns the amount the coinbase of the block at height may
+// create on top of the fees. The subsidy halves every HalvingInterval blocks
+// until nothing is left of it.
+func (p *ChainParams) BlockSubsidy(height int) int {
+	halvings := height / p.HalvingInterval
+	if halvings >= maxHalvings {
+		return 0
+	}
+
+	return p.Subsidy >> uint(halvings)
+}
+
+// MaxSupply returns the number of coins the network will have issued once
+// the subsidy has run out, the genesis reward included
+func (p *ChainParams) MaxSupply() int {
+	supply := 0
+	for halvings := uint(0); halvings < maxHalvings; halvings++ {
+		supply += (p.Subsidy >> halvings) * p.HalvingInterval
+	}
+
+	return supply
+}
+
+// IssuedSupply returns the number of coins the schedule allows to be issued
+// by the blocks up to and including height
+func (p *ChainParams) IssuedSupply(height int) int {
+	supply := 0
+	for h := 0; h <= height; {
+		subsidy := p.BlockSubsidy(h)
+		if subsidy == 0 {
+			break
+		}
+
+		next := (h/p.HalvingInterval + 1) * p.HalvingInterval
+		if next > height+1 {
+			next = height + 1
+		}
+		supply += subsidy * (next - h)
+		h = next
+	}
+
+	return supply
+}
@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	params := &ChainParams{Subsidy: 10, HalvingInterval: 150}
+
+	tests := []struct {
+		height, subsidy int
+	}{
+		{0, 10},
+		{149, 10},
+		{150, 5},
+		{299, 5},
+		{300, 2},
+		{450, 1},
+		{600, 0},
+		{150 * maxHalvings, 0},
+	}
+
+	for _, test := range tests {
+		subsidy := params.BlockSubsidy(test.height)
+		if subsidy != test.subsidy {
+			t.Errorf("subsidy at height %d is %d, want %d", test.height, subsidy, test.subsidy)
+		}
+	}
+}
+
+func TestSupply(t *testing.T) {
+	params := &ChainParams{Subsidy: 10, HalvingInterval: 150}
+
+	if supply := params.MaxSupply(); supply != (10+5+2+1)*150 {
+		t.Errorf("max supply %d, want %d", supply, (10+5+2+1)*150)
+	}
+
+	tests := []struct {
+		height, supply int
+	}{
+		{0, 10},
+		{149, 1500},
+		{150, 1505},
+		{449, 2550},
+		{100000, params.MaxSupply()},
+	}
+
+	for _, test := range tests {
+		supply := params.IssuedSupply(test.height)
+		if supply != test.supply {
+			t.Errorf("supply issued up to height %d is %d, want %d", test.height, supply, test.supply)
+		}
+	}
+
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.MaxSupply() > params.MaxMoney {
+			t.Errorf("%s issues %d, more than its maximum amount of money %d", params.Name, params.MaxSupply(), params.MaxMoney)
+		}
+	}
+}
+
+func TestHalvedSubsidyEnforced(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	mineBlocks(t, bc, address, bc.Params.HalvingInterval-1)
+
+	block := newTestBlock(t, bc, address, 0)
+	if block.Height != bc.Params.HalvingInterval || block.Transactions[0].Vout[0].Value != bc.Params.Subsidy/2 {
+		t.Fatalf("coinbase at height %d pays %d", block.Height, block.Transactions[0].Vout[0].Value)
+	}
+	err := bc.ValidateBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The coinbase claims the subsidy from before the halving
+	block = newTestBlock(t, bc, address, bc.Params.Subsidy-bc.Params.Subsidy/2)
+	err = bc.ValidateBlock(block)
+	if !errors.Is(err, ErrBadCoinbaseValue) {
+		t.Errorf("got %v, want %v", err, ErrBadCoinbaseValue)
+	}
+}
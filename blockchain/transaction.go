@@ -6,14 +6,18 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 )
 
-const subsidy = 10
+// ErrInsufficientFunds is returned when a wallet cannot cover a payment
+var ErrInsufficientFunds = errors.New("not enough funds")
 
 type Transaction struct {
 	ID   []byte
@@ -85,37 +89,93 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func NewCoinbaseTX(to, data string) *Transaction {
+// gob numbers types in the order a process first encodes them, and the
+// numbers are part of the encoding. Encoding a transaction before anything
+// else makes Serialize, and so transaction IDs, the same in every process.
+func init() {
+	err := gob.NewEncoder(ioutil.Discard).Encode(&Transaction{})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// coinbaseHeaderSize is the length of the block height and extra nonce that
+// start the data of a coinbase input
+const coinbaseHeaderSize = 16
+
+// coinbaseData returns the data of a coinbase input. The height of the block
+// and an extra nonce come first so that no two coinbases share an ID, even
+// when they pay the same amount to the same address.
+func coinbaseData(height int, extraNonce uint64, data string) []byte {
+	buf := make([]byte, coinbaseHeaderSize, coinbaseHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(height))
+	binary.BigEndian.PutUint64(buf[8:], extraNonce)
+
+	return append(buf, data...)
+}
+
+// CoinbaseHeight returns the block height encoded in a coinbase transaction.
+// It reports false if tx is not a coinbase or encodes no height.
+func (tx Transaction) CoinbaseHeight() (int, bool) {
+	if !tx.IsCoinbase() || len(tx.Vin[0].PubKey) < coinbaseHeaderSize {
+		return 0, false
+	}
+
+	return int(binary.BigEndian.Uint64(tx.Vin[0].PubKey)), true
+}
+
+// NewCoinbaseTX creates the transaction paying the subsidy of the block at
+// height and the fees of the block's transactions to the miner. Its input
+// encodes the height and a random extra nonce ahead of data.
+func NewCoinbaseTX(to, data string, height, fees int, params *ChainParams) (*Transaction, error) {
+	if !ValidateAddress(to, params) {
+		return nil, ErrInvalidAddress
+	}
+
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s", to)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
+	var extraNonce [8]byte
+	_, err := rand.Read(extraNonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	txin := TXInput{[]byte{}, -1, nil, coinbaseData(height, binary.BigEndian.Uint64(extraNonce[:]), data)}
+	txout := NewTXOutput(params.BlockSubsidy(height)+fees, to)
 	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
 
-// NewUTXOTransaction creates a new transaction
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction creates a new transaction sending amount to the
+// recipient. The fee is left unclaimed by the outputs so the miner can
+// collect it.
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet) (*Transaction, error) {
 	var inputs []TXInput
 	var outputs []TXOutput
 
+	if !ValidateAddress(to, UTXOSet.Blockchain.Params) {
+		return nil, ErrInvalidAddress
+	}
+
 	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs, err := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
 
-	if acc < amount {
-		log.Panic("ERROR: not enough funds")
+	if acc < amount+fee {
+		return nil, ErrInsufficientFunds
 	}
 
 	// Build a list of inputs.
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 
 		for _, out := range outs {
@@ -127,14 +187,18 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 	// Build a list of outputs.
 	from := fmt.Sprintf("%s", wallet.GetAddress())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
 
 	tx := Transaction{nil, inputs, outputs}
+	err = UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKet)
+	if err != nil {
+		return nil, err
+	}
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKet)
-	return &tx
+
+	return &tx, nil
 }
 
 // TrimmedCopy creates a trimmed copy of Transaction to be used in signing
@@ -155,41 +219,57 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return txCopy
 }
 
-// Sign signs each Transaction input
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign signs each Transaction input. prevOuts holds the outputs the inputs
+// spend, keyed by outpointID.
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevOuts map[string]TXOutput) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	txCopy := tx.TrimmedCopy()
 
 	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		prevOut, ok := prevOuts[outpointID(vin.Txid, vin.Vout)]
+		if !ok {
+			return &TxError{tx.ID, ErrMissingInput}
+		}
+
 		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
 		txCopy.ID = txCopy.Hash()
 		txCopy.Vin[inID].PubKey = nil
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+		signature := joinInts(r, s)
 		tx.Vin[inID].Signature = signature
 	}
+
+	return nil
 }
 
-// Verify verifies signatures of transaction inputs
-func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
+// Verify verifies signatures of transaction inputs against prevOuts, the
+// outputs they spend keyed by outpointID. Inputs referring to missing outputs
+// or carrying malformed keys and signatures fail verification.
+func (tx *Transaction) Verify(prevOuts map[string]TXOutput) bool {
 	txCopy := tx.TrimmedCopy()
 	curve := elliptic.P256()
 
 	for inID, vin := range tx.Vin {
-		prevTx := prevTxs[hex.EncodeToString(vin.Txid)]
+		prevOut, ok := prevOuts[outpointID(vin.Txid, vin.Vout)]
+		if !ok {
+			return false
+		}
+
+		if len(vin.Signature) == 0 || len(vin.PubKey) == 0 {
+			return false
+		}
+
 		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
 		txCopy.ID = txCopy.Hash()
 		txCopy.Vin[inID].PubKey = nil
 
@@ -205,6 +285,10 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		x.SetBytes(vin.PubKey[:(keyLen / 2)])
 		y.SetBytes(vin.PubKey[(keyLen / 2):])
 
+		if !curve.IsOnCurve(&x, &y) {
+			return false
+		}
+
 		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
 			return false
@@ -213,15 +297,12 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 	return true
 }
 
-// DeserializeTransaction deserializes a transaction
-func DeserializeTransaction(data []byte) Transaction {
+// DeserializeTransaction deserializes a transaction, failing on malformed data
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
-	if err != nil {
-		log.Panic(err)
-	}
 
-	return transaction
+	return transaction, err
 }
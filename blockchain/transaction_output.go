@@ -2,21 +2,60 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"log"
 )
 
-// TXOutputs collects TXOutput
-type TXOutputs struct {
-	Ouputs []TXOutput
+// outpointSize is the length of an outpoint key: a transaction ID followed by
+// the index of one of its outputs
+const outpointSize = 32 + 4
+
+// UTXOEntry is an unspent output in the UTXO set, along with the height of
+// the block that included its transaction and whether it is a coinbase
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// outpointKey returns the UTXO set key of output vout of transaction txID
+func outpointKey(txID []byte, vout int) []byte {
+	key := make([]byte, len(txID)+4)
+	copy(key, txID)
+	binary.BigEndian.PutUint32(key[len(txID):], uint32(vout))
+
+	return key
+}
+
+// outpointID returns the hex encoded outpoint key of output vout of
+// transaction txID, which keys maps of outputs
+func outpointID(txID []byte, vout int) string {
+	return hex.EncodeToString(outpointKey(txID, vout))
+}
+
+// splitOutpointKey returns the transaction ID and output index of a UTXO set
+// key
+func splitOutpointKey(key []byte) ([]byte, int) {
+	txID := key[:len(key)-4]
+	vout := binary.BigEndian.Uint32(key[len(key)-4:])
+
+	return txID, int(vout)
+}
+
+// IsMature reports whether the output can be spent by a transaction in the
+// block at height
+func (entry UTXOEntry) IsMature(height, maturity int) bool {
+	return !entry.Coinbase || height-entry.Height >= maturity
 }
 
-// Serialize serializes TXOutputs
-func (outs TXOutputs) Serialize() []byte {
+// Serialize serializes the UTXOEntry
+func (entry UTXOEntry) Serialize() []byte {
 	var buff bytes.Buffer
 
 	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
+	err := enc.Encode(entry)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -24,15 +63,12 @@ func (outs TXOutputs) Serialize() []byte {
 	return buff.Bytes()
 }
 
-// DeserializeOutputs deserializes TXOutputs
-func DeserializeOutputs(data []byte) TXOutputs {
-	var outputs TXOutputs
+// DeserializeUTXOEntry deserializes a UTXOEntry
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var entry UTXOEntry
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outputs)
-	if err != nil {
-		log.Panic(err)
-	}
+	err := dec.Decode(&entry)
 
-	return outputs
+	return entry, err
 }
@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// txIndexBucket maps the ID of every transaction in the active chain to its
+// location. The index is optional and only maintained while the bucket exists.
+const txIndexBucket = "txindex"
+
+// txLocation tells where a transaction of the active chain is stored
+type txLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (loc txLocation) serialize() ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(loc)
+
+	return buff.Bytes(), err
+}
+
+func deserializeTxLocation(data []byte) (txLocation, error) {
+	var loc txLocation
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&loc)
+
+	return loc, err
+}
+
+// indexTransactions adds the transactions of a connected block to the index
+func indexTransactions(tx Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for i, transaction := range block.Transactions {
+		data, err := txLocation{block.Hash, i}.serialize()
+		if err != nil {
+			return err
+		}
+
+		err = b.Put(transaction.ID, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions removes the transactions of a disconnected block
+func unindexTransactions(tx Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		err := b.Delete(transaction.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReindexTransactions enables the transaction index and rebuilds it from the
+// active chain
+func (bc *Blockchain) ReindexTransactions() error {
+	return bc.rebuildIndex(txIndexBucket, indexTransactions)
+}
+
+// DropTransactionIndex disables the transaction index
+func (bc *Blockchain) DropTransactionIndex() error {
+	return bc.dropIndex(txIndexBucket)
+}
+
+// rebuildIndex recreates an optional index bucket and fills it by passing
+// every block of the active chain to index, from genesis to tip
+func (bc *Blockchain) rebuildIndex(bucket string, index func(Tx, *Block) error) error {
+	return bc.Db.Update(func(tx Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		c := tx.Bucket([]byte(heightsBucket)).Cursor()
+
+		for _, hash := c.First(); hash != nil; _, hash = c.Next() {
+			block, err := loadBlock(blocks, hash)
+			if err != nil {
+				return err
+			}
+
+			err = index(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// dropIndex removes an optional index bucket, which disables the index
+func (bc *Blockchain) dropIndex(bucket string) error {
+	return bc.Db.Update(func(tx Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err == ErrBucketNotFound {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// findIndexedTransaction looks a transaction up in the index. It reports
+// false if the index is disabled.
+func (bc *Blockchain) findIndexedTransaction(ID []byte) (Transaction, bool, error) {
+	var loc txLocation
+	var indexed bool
+
+	err := bc.Db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(txIndexBucket))
+		if b == nil {
+			return nil
+		}
+		indexed = true
+
+		data := b.Get(ID)
+		if data == nil {
+			return ErrTransactionNotFound
+		}
+
+		var err error
+		loc, err = deserializeTxLocation(data)
+
+		return err
+	})
+	if !indexed || err != nil {
+		return Transaction{}, indexed, err
+	}
+
+	block, err := bc.GetBlock(loc.BlockHash)
+	if err != nil {
+		return Transaction{}, true, err
+	}
+
+	return *block.Transactions[loc.Position], true, nil
+}
@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkFound checks that FindTransaction finds each of txs, and whether it
+// went through the transaction index to do so
+func checkFound(t *testing.T, bc *Blockchain, indexed bool, txs ...*Transaction) {
+	for _, tx := range txs {
+		found, err := bc.FindTransaction(tx.ID)
+		if err != nil || !bytes.Equal(found.Hash(), tx.Hash()) {
+			t.Errorf("transaction %x found as %x, %v", tx.ID, found.ID, err)
+		}
+
+		_, fromIndex, _ := bc.findIndexedTransaction(tx.ID)
+		if fromIndex != indexed {
+			t.Errorf("transaction %x looked up in the index: %v, want %v", tx.ID, fromIndex, indexed)
+		}
+	}
+}
+
+func TestTransactionIndex(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+	first := blocks[0].Transactions[0]
+
+	spend := newTestSpend(t, wallet, first, 0, other, first.Vout[0].Value)
+	cbTx, err := NewCoinbaseTX(address, "", len(blocks)+1, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock([]*Transaction{cbTx, spend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, bc, false, first, cbTx, spend)
+
+	err = bc.ReindexTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, bc, true, first, cbTx, spend)
+
+	// Blocks connected after the rebuild are indexed as they come
+	mined := mineBlocks(t, bc, address, 1)
+	checkFound(t, bc, true, mined[0].Transactions[0])
+
+	// A longer branch leaving out the block holding the spend drops it and
+	// the coinbases above it from the index
+	side := extendBranch(t, bc, blocks[len(blocks)-1].Hash, other, 3)
+	tip, err := bc.GetBlock(side)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, bc, true, first, tip.Transactions[0])
+
+	for _, tx := range []*Transaction{cbTx, spend, mined[0].Transactions[0]} {
+		_, err := bc.FindTransaction(tx.ID)
+		if err != ErrTransactionNotFound {
+			t.Errorf("detached transaction %x: got %v, want %v", tx.ID, err, ErrTransactionNotFound)
+		}
+	}
+
+	err = bc.DropTransactionIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, bc, false, first, tip.Transactions[0])
+
+	_, err = bc.FindTransaction(spend.ID)
+	if err != ErrTransactionNotFound {
+		t.Errorf("detached transaction without the index: got %v, want %v", err, ErrTransactionNotFound)
+	}
+}
@@ -0,0 +1,48 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+)
+
+const undoBucket = "undo"
+
+// ErrNoUndoData is returned when disconnecting a block from the UTXO set
+// without the undo record written when it was connected
+var ErrNoUndoData = errors.New("no undo data for block")
+
+// ErrBadUndoData is returned when the undo record of a block does not match
+// the outputs its inputs spend
+var ErrBadUndoData = errors.New("undo data does not match the block")
+
+// blockUndo records the outputs a block spent, in the order its inputs
+// spend them, so that the block can be disconnected without rescanning the
+// chain
+type blockUndo struct {
+	Spent []UTXOEntry
+}
+
+// Serialize serializes the undo record
+func (u blockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(u)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// deserializeUndo decodes an undo record
+func deserializeUndo(data []byte) (blockUndo, error) {
+	var undo blockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+
+	return undo, err
+}
@@ -1,9 +1,9 @@
 package blockchain
 
 import (
+	"bytes"
 	"encoding/hex"
-	bolt "go.etcd.io/bbolt"
-	"log"
+	"errors"
 )
 
 // UTXOSet represents the UTXO set
@@ -13,159 +13,388 @@ type UTXOSet struct {
 
 const utxoBucket = "chainstate"
 
-// FindSpendableOutputs finds and returns unspent outputs to reference in inputs
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+// utxoAddrBucket indexes the UTXO set by pubkey hash. Keys are the pubkey
+// hash followed by the outpoint key, with empty values, so the unspent
+// outputs of an address are a contiguous range.
+const utxoAddrBucket = "utxoaddr"
+
+// utxoBuckets are the buckets holding the UTXO set, its index and the undo
+// records of the blocks connected to it
+var utxoBuckets = []string{utxoBucket, utxoAddrBucket, undoBucket}
+
+// utxoVersionKey records in the meta bucket the format of the UTXO set and
+// its undo records, which are rebuilt when written in an older one
+var utxoVersionKey = []byte("utxoversion")
+var utxoVersion = []byte{4}
+
+// utxoTipKey records in the meta bucket the block the UTXO set ends at
+var utxoTipKey = []byte("utxotip")
+
+// ErrUTXOMismatch is returned when connecting or disconnecting a block that
+// does not follow or end the UTXO set
+var ErrUTXOMismatch = errors.New("UTXO set does not match the block")
+
+// FindSpendableOutputs finds and returns unspent outputs to reference in
+// inputs, leaving out coinbase outputs that are not mature yet
+func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.Db
+	maturity := u.Blockchain.Params.CoinbaseMaturity
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+	err := db.View(func(tx Tx) error {
+		tip, err := getTipInfo(tx)
+		if err != nil {
+			return err
+		}
 
-			for outIdx, output := range outs.Ouputs {
-				if output.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += output.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
+		return forEachAddressUTXO(tx, pubkeyHash, func(key []byte, entry UTXOEntry) error {
+			if accumulated >= amount || !entry.IsMature(tip.Height+1, maturity) {
+				return nil
 			}
-		}
 
-		return nil
-	})
+			txID, vout := splitOutpointKey(key)
+			txKey := hex.EncodeToString(txID)
+			accumulated += entry.Output.Value
+			unspentOutputs[txKey] = append(unspentOutputs[txKey], vout)
 
+			return nil
+		})
+	})
 	if err != nil {
-		log.Panic(err)
+		return 0, nil, err
 	}
 
-	return accumulated, unspentOutputs
+	return accumulated, unspentOutputs, nil
 }
 
 // FindUTXO finds UTXO for a public key hash
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
 	var UTXOs []TXOutput
 	db := u.Blockchain.Db
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx Tx) error {
+		return forEachAddressUTXO(tx, pubKeyHash, func(key []byte, entry UTXOEntry) error {
+			UTXOs = append(UTXOs, entry.Output)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return UTXOs, nil
+}
+
+// Balance returns the value of the outputs locked with pubKeyHash that can be
+// spent in the next block, and the value of those that are immature coinbase
+// outputs
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int, error) {
+	var balance, immature int
+	db := u.Blockchain.Db
+	maturity := u.Blockchain.Params.CoinbaseMaturity
+
+	err := db.View(func(tx Tx) error {
+		tip, err := getTipInfo(tx)
+		if err != nil {
+			return err
+		}
+
+		return forEachAddressUTXO(tx, pubKeyHash, func(key []byte, entry UTXOEntry) error {
+			if entry.IsMature(tip.Height+1, maturity) {
+				balance += entry.Output.Value
+			} else {
+				immature += entry.Output.Value
+			}
+			return nil
+		})
+	})
+
+	return balance, immature, err
+}
+
+// Supply returns the total value of the unspent outputs, which is the
+// number of coins issued so far
+func (u UTXOSet) Supply() (int, error) {
+	supply := 0
+	db := u.Blockchain.Db
+
+	err := db.View(func(tx Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
-
-			for _, output := range outs.Ouputs {
-				if output.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, output)
-				}
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
 			}
+
+			supply += entry.Output.Value
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
 
-	return UTXOs
+	return supply, err
 }
 
-// Update updates the UTXO set with transactions from the Block.
-// The block is considered to be the tip of a blockchain.
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Db
+// Update connects the block to the UTXO set, unless it already is. Blocks
+// mined or added through the Blockchain are connected along with the chain
+// tip, so it is only needed for blocks connected by hand.
+func (u UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Db.Update(func(tx Tx) error {
+		if bytes.Equal(tx.Bucket([]byte(metaBucket)).Get(utxoTipKey), block.Hash) {
+			return nil
+		}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+		return connectUTXO(tx, block)
+	})
+}
 
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, output := range outs.Ouputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Ouputs = append(updatedOuts.Ouputs, output)
-						}
-					}
-
-					if len(updatedOuts.Ouputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
-				}
+// Disconnect reverts Update, restoring the outputs spent by the block and
+// removing those it created. The block has to be the last one connected.
+func (u UTXOSet) Disconnect(block *Block) error {
+	return u.Blockchain.Db.Update(func(tx Tx) error {
+		return disconnectUTXO(tx, block)
+	})
+}
+
+// Reindex rebuilds the UTXO set and the undo records by connecting the
+// blocks of the active chain from the genesis block on. The old set is
+// replaced in the same transaction, so it is kept if rebuilding fails.
+func (u UTXOSet) Reindex() error {
+	db := u.Blockchain.Db
+
+	return db.Update(func(tx Tx) error {
+		for _, name := range utxoBuckets {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != ErrBucketNotFound {
+				return err
 			}
+		}
+
+		err := createUTXOBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		tip, err := getTipInfo(tx)
+		if err != nil {
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightsBucket))
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Ouputs = append(newOutputs.Ouputs, out)
+		for height := 0; height <= tip.Height; height++ {
+			block, err := loadBlock(blocks, heights.Get(heightKey(height)))
+			if err != nil {
+				return err
 			}
 
-			err := b.Put(tx.ID, newOutputs.Serialize())
+			err = connectUTXO(tx, block)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
 		}
 
 		return nil
 	})
+}
+
+// createUTXOBuckets creates an empty UTXO set, address index and undo bucket
+// in the current format
+func createUTXOBuckets(tx Tx) error {
+	for _, name := range utxoBuckets {
+		_, err := tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
 
+	meta := tx.Bucket([]byte(metaBucket))
+
+	err := meta.Delete(utxoTipKey)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	return meta.Put(utxoVersionKey, utxoVersion)
 }
 
-// Reindex rebuilds the UTXO set
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Db
-	bucketName := []byte(utxoBucket)
+// utxoInSync reports whether the UTXO set is in the current format and
+// reflects the chain ending at tip
+func utxoInSync(tx Tx, tip []byte) bool {
+	meta := tx.Bucket([]byte(metaBucket))
+
+	return bytes.Equal(meta.Get(utxoVersionKey), utxoVersion) && bytes.Equal(meta.Get(utxoTipKey), tip)
+}
+
+func utxoAddrKey(pubKeyHash, outpoint []byte) []byte {
+	return bytes.Join([][]byte{pubKeyHash, outpoint}, []byte{})
+}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
+// putUTXO adds an entry to the UTXO set and its address index
+func putUTXO(tx Tx, key []byte, entry UTXOEntry) error {
+	err := tx.Bucket([]byte(utxoBucket)).Put(key, entry.Serialize())
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(utxoAddrBucket)).Put(utxoAddrKey(entry.Output.PubKeyHash, key), []byte{})
+}
+
+// deleteUTXO removes an entry locked with pubKeyHash from the UTXO set and
+// its address index
+func deleteUTXO(tx Tx, key, pubKeyHash []byte) error {
+	err := tx.Bucket([]byte(utxoBucket)).Delete(key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(utxoAddrBucket)).Delete(utxoAddrKey(pubKeyHash, key))
+}
+
+// forEachAddressUTXO calls fn with the key and entry of every unspent output
+// locked with pubKeyHash, reading only the outputs of that address
+func forEachAddressUTXO(tx Tx, pubKeyHash []byte, fn func(key []byte, entry UTXOEntry) error) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	c := tx.Bucket([]byte(utxoAddrBucket)).Cursor()
+
+	for k, _ := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k, pubKeyHash); k, _ = c.Next() {
+		// A longer pubkey hash starting with this one has a longer key
+		if len(k) != len(pubKeyHash)+outpointSize {
+			continue
 		}
+		key := k[len(pubKeyHash):]
 
-		_, err = tx.CreateBucket(bucketName)
+		entry, err := DeserializeUTXOEntry(b.Get(key))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
+		err = fn(key, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connectUTXO removes the outputs the block's transactions spend and adds
+// the ones they create, and stores the undo record of the spent outputs. The
+// UTXO set has to end at the block's parent.
+func connectUTXO(tx Tx, block *Block) error {
+	var undo blockUndo
+	b := tx.Bucket([]byte(utxoBucket))
+	meta := tx.Bucket([]byte(metaBucket))
+
+	if !bytes.Equal(meta.Get(utxoTipKey), block.PrevBlockHash) {
+		return ErrUTXOMismatch
 	}
 
-	UTXO := u.Blockchain.FindUTXO()
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() == false {
+			for _, vin := range transaction.Vin {
+				key := outpointKey(vin.Txid, vin.Vout)
+				data := b.Get(key)
+				if data == nil {
+					return &TxError{transaction.ID, ErrMissingInput}
+				}
+
+				entry, err := DeserializeUTXOEntry(data)
+				if err != nil {
+					return err
+				}
+				undo.Spent = append(undo.Spent, entry)
+
+				err = deleteUTXO(tx, key, entry.Output.PubKeyHash)
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+		for outIdx, out := range transaction.Vout {
+			entry := UTXOEntry{out, block.Height, transaction.IsCoinbase()}
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
+			err := putUTXO(tx, outpointKey(transaction.ID, outIdx), entry)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
+		}
+	}
+
+	err := tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+	if err != nil {
+		return err
+	}
 
-			err = b.Put(key, outs.Serialize())
+	return meta.Put(utxoTipKey, block.Hash)
+}
+
+// disconnectUTXO removes the outputs the block created and restores the ones
+// it spent. Transactions are undone last to first, so that outputs created
+// and spent within the block end up removed. The UTXO set has to end at the
+// block.
+func disconnectUTXO(tx Tx, block *Block) error {
+	undoBkt := tx.Bucket([]byte(undoBucket))
+	meta := tx.Bucket([]byte(metaBucket))
+
+	if !bytes.Equal(meta.Get(utxoTipKey), block.Hash) {
+		return ErrUTXOMismatch
+	}
+
+	data := undoBkt.Get(block.Hash)
+	if data == nil {
+		return ErrNoUndoData
+	}
+
+	undo, err := deserializeUndo(data)
+	if err != nil {
+		return err
+	}
+	spent := undo.Spent
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+
+		for outIdx, out := range transaction.Vout {
+			err = deleteUTXO(tx, outpointKey(transaction.ID, outIdx), out.PubKeyHash)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
+		}
 
+		if transaction.IsCoinbase() {
+			continue
 		}
-		return nil
-	})
+
+		for j := len(transaction.Vin) - 1; j >= 0; j-- {
+			if len(spent) == 0 {
+				return ErrBadUndoData
+			}
+
+			vin := transaction.Vin[j]
+			entry := spent[len(spent)-1]
+			spent = spent[:len(spent)-1]
+
+			err = putUTXO(tx, outpointKey(vin.Txid, vin.Vout), entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(spent) != 0 {
+		return ErrBadUndoData
+	}
+
+	err = undoBkt.Delete(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	return meta.Put(utxoTipKey, block.PrevBlockHash)
 }
@@ -0,0 +1,132 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// dumpBucket returns the content of the named bucket
+func dumpBucket(t *testing.T, bc *Blockchain, name string) map[string]string {
+	content := make(map[string]string)
+
+	err := bc.Db.View(func(tx Tx) error {
+		c := tx.Bucket([]byte(name)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			content[string(k)] = string(v)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// checkReindexed checks that rebuilding the UTXO set of bc from its blocks
+// gives the set and address index updated block by block
+func checkReindexed(t *testing.T, bc *Blockchain) {
+	var before []map[string]string
+	for _, name := range []string{utxoBucket, utxoAddrBucket} {
+		before = append(before, dumpBucket(t, bc, name))
+	}
+
+	err := UTXOSet{bc}.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{utxoBucket, utxoAddrBucket} {
+		after := dumpBucket(t, bc, name)
+		if len(after) != len(before[i]) {
+			t.Errorf("%s holds %d entries, %d after reindexing", name, len(before[i]), len(after))
+			continue
+		}
+
+		for k, v := range after {
+			if before[i][k] != v {
+				t.Errorf("%s entry %x differs after reindexing", name, k)
+			}
+		}
+	}
+}
+
+// extendBranch mines n blocks on top of the block tip and adds them to bc,
+// the first one holding transactions. It returns the hash of the last one.
+func extendBranch(t *testing.T, bc *Blockchain, tip []byte, address string, n int, transactions ...*Transaction) []byte {
+	parent, err := bc.GetBlock(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= n; i++ {
+		cbTx, err := NewCoinbaseTX(address, "", parent.Height+1, 0, bc.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i > 1 {
+			transactions = nil
+		}
+		block, err := NewBlock(append([]*Transaction{cbTx}, transactions...), parent.Hash, parent.Height+1, parent.Bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = *block
+	}
+
+	return parent.Hash
+}
+
+func TestReorgMatchesReindex(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+2)
+	first := blocks[0].Transactions[0]
+	second := blocks[1].Transactions[0]
+
+	fork, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both branches spend the first coinbase, so that switching branches has
+	// to restore it from the undo records
+	mainTip := extendBranch(t, bc, fork, address, 2,
+		newTestSpend(t, wallet, first, 0, other, first.Vout[0].Value),
+		newTestSpend(t, wallet, second, 0, other, second.Vout[0].Value))
+	checkReindexed(t, bc)
+
+	sideTip := extendBranch(t, bc, fork, other, 3,
+		newTestSpend(t, wallet, first, 0, address, first.Vout[0].Value))
+	tip, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tip, sideTip) {
+		t.Fatalf("tip %x, want the side branch tip %x", tip, sideTip)
+	}
+	checkReindexed(t, bc)
+
+	mainTip = extendBranch(t, bc, mainTip, address, 2)
+	tip, err = bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tip, mainTip) {
+		t.Fatalf("tip %x, want the main branch tip %x", tip, mainTip)
+	}
+	checkReindexed(t, bc)
+
+	err = bc.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Error(err)
+	}
+}
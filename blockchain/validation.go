@@ -0,0 +1,527 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Reasons a block can be rejected, wrapped in a BlockError
+var (
+	ErrNoTransactions    = errors.New("block has no transactions")
+	ErrBadBlockHash      = errors.New("block hash does not match its header and merkle root")
+	ErrBadProofOfWork    = errors.New("block hash does not satisfy the proof of work target")
+	ErrUnknownParent     = errors.New("previous block is unknown")
+	ErrBadHeight         = errors.New("block height does not follow its parent")
+	ErrBadDifficulty     = errors.New("block does not use the expected difficulty")
+	ErrBadTimestamp      = errors.New("block timestamp is out of range")
+	ErrBadCoinbase       = errors.New("block must contain exactly one coinbase transaction")
+	ErrBadCoinbaseValue  = errors.New("coinbase pays more than the subsidy plus fees")
+	ErrBadFees           = errors.New("block fees exceed the maximum amount of money")
+	ErrBadCoinbaseHeight = errors.New("coinbase does not encode the block height")
+)
+
+// Reasons a transaction can be rejected, wrapped in a TxError
+var (
+	ErrNoInputs          = errors.New("transaction has no inputs")
+	ErrNoOutputs         = errors.New("transaction has no outputs")
+	ErrBadTxID           = errors.New("transaction ID does not match its contents")
+	ErrBadOutputValue    = errors.New("output value must be positive")
+	ErrValueOutOfRange   = errors.New("transaction amount exceeds the maximum amount of money")
+	ErrDuplicateInput    = errors.New("transaction spends the same output twice")
+	ErrBadOutputIndex    = errors.New("transaction input refers to an output index out of range")
+	ErrMissingInput      = errors.New("transaction spends an unknown output")
+	ErrSpentInput        = errors.New("transaction spends an already spent output")
+	ErrImmatureSpend     = errors.New("transaction spends an immature coinbase output")
+	ErrInputKeyMismatch  = errors.New("input public key does not match the spent output")
+	ErrInsufficientInput = errors.New("transaction inputs are worth less than its outputs")
+	ErrBadSignature      = errors.New("transaction signature is not valid")
+	ErrLooseCoinbase     = errors.New("coinbase transaction outside of a block")
+	ErrTxInMempool       = errors.New("transaction is already in the mempool")
+)
+
+// BlockError is returned when a block fails validation
+type BlockError struct {
+	Hash []byte
+	Err  error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %x rejected: %s", e.Hash, e.Err)
+}
+
+// Unwrap returns the reason the block was rejected
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// TxError is returned when a transaction fails validation
+type TxError struct {
+	ID  []byte
+	Err error
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transaction %x rejected: %s", e.ID, e.Err)
+}
+
+// Unwrap returns the reason the transaction was rejected
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// CheckTransaction runs the checks that do not depend on the chain state of
+// the network of params
+func CheckTransaction(tx *Transaction, params *ChainParams) error {
+	if len(tx.Vin) == 0 {
+		return &TxError{tx.ID, ErrNoInputs}
+	}
+
+	if len(tx.Vout) == 0 {
+		return &TxError{tx.ID, ErrNoOutputs}
+	}
+
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return &TxError{tx.ID, ErrBadTxID}
+	}
+
+	outputs := 0
+	for _, out := range tx.Vout {
+		// Once the subsidy has run out, the coinbase of a block without
+		// fees pays nothing
+		if out.Value < 0 || out.Value == 0 && !tx.IsCoinbase() {
+			return &TxError{tx.ID, ErrBadOutputValue}
+		}
+
+		if out.Value > params.MaxMoney-outputs {
+			return &TxError{tx.ID, ErrValueOutOfRange}
+		}
+		outputs += out.Value
+	}
+
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	// Outpoint keys hold the output index in four bytes, so indexes past
+	// them would alias other outputs
+	spent := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		if vin.Vout < 0 || int64(vin.Vout) > math.MaxUint32 {
+			return &TxError{tx.ID, ErrBadOutputIndex}
+		}
+
+		outpoint := outpointID(vin.Txid, vin.Vout)
+		if spent[outpoint] {
+			return &TxError{tx.ID, ErrDuplicateInput}
+		}
+		spent[outpoint] = true
+	}
+
+	return nil
+}
+
+// CheckTxInputs checks the inputs of tx against prevOuts, the outputs they
+// spend keyed by outpointID, and returns the fee, the amount by which the
+// inputs exceed the outputs
+func CheckTxInputs(tx *Transaction, prevOuts map[string]TXOutput, params *ChainParams) (int, error) {
+	var inputs, outputs int
+
+	for _, vin := range tx.Vin {
+		prevOut, ok := prevOuts[outpointID(vin.Txid, vin.Vout)]
+		if !ok {
+			return 0, &TxError{tx.ID, ErrMissingInput}
+		}
+
+		if !vin.UsesKey(prevOut.PubKeyHash) {
+			return 0, &TxError{tx.ID, ErrInputKeyMismatch}
+		}
+
+		if prevOut.Value < 0 || prevOut.Value > params.MaxMoney-inputs {
+			return 0, &TxError{tx.ID, ErrValueOutOfRange}
+		}
+		inputs += prevOut.Value
+	}
+
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > params.MaxMoney-outputs {
+			return 0, &TxError{tx.ID, ErrValueOutOfRange}
+		}
+		outputs += out.Value
+	}
+
+	if inputs < outputs {
+		return 0, &TxError{tx.ID, ErrInsufficientInput}
+	}
+
+	return inputs - outputs, nil
+}
+
+// utxoView is the UTXO set at a given block. It reads the chainstate and
+// overlays the outputs created and spent between the chainstate's tip and
+// that block, and by the transactions added to the view since, so that
+// blocks on any branch can be checked without rescanning the chain.
+type utxoView struct {
+	// base is the chainstate bucket, or nil for a view held in memory
+	base Bucket
+	// entries overlays base, keyed by outpointID. A nil entry is an output
+	// that base holds but the view does not.
+	entries map[string]*UTXOEntry
+	// height is the height of the block the view is checking transactions
+	// for, the one after the block it was built at
+	height int
+	params *ChainParams
+}
+
+// newUTXOView returns a view of base at the block below height. A nil base
+// starts an empty view held in memory.
+func newUTXOView(base Bucket, height int, params *ChainParams) *utxoView {
+	return &utxoView{base, make(map[string]*UTXOEntry), height, params}
+}
+
+// utxoViewAt returns the view of the UTXO set at the block blockHash, which
+// does not have to be on the active chain. The chainstate is rolled back to
+// the fork point with the undo records of the blocks above it, and the
+// blocks of blockHash's branch are applied, in memory.
+func utxoViewAt(tx Tx, blockHash []byte, params *ChainParams) (*utxoView, error) {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	utxoTip := tx.Bucket([]byte(metaBucket)).Get(utxoTipKey)
+
+	block, err := loadBlock(blocks, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	view := newUTXOView(tx.Bucket([]byte(utxoBucket)), block.Height+1, params)
+	if bytes.Equal(utxoTip, blockHash) {
+		return view, nil
+	}
+
+	detached, attached, err := findFork(blocks, utxoTip, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	undoBkt := tx.Bucket([]byte(undoBucket))
+	for _, block := range detached {
+		data := undoBkt.Get(block.Hash)
+		if data == nil {
+			return nil, ErrNoUndoData
+		}
+
+		undo, err := deserializeUndo(data)
+		if err != nil {
+			return nil, err
+		}
+
+		err = view.disconnect(block, undo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, block := range attached {
+		for _, transaction := range block.Transactions {
+			_, err = view.add(transaction, block.Height)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return view, nil
+}
+
+// lookup returns the unspent output of the view for output vout of
+// transaction txID
+func (v *utxoView) lookup(txID []byte, vout int) (UTXOEntry, error) {
+	entry, ok := v.entries[outpointID(txID, vout)]
+	if ok && entry == nil {
+		return UTXOEntry{}, ErrSpentInput
+	}
+	if ok {
+		return *entry, nil
+	}
+
+	var data []byte
+	if v.base != nil && vout >= 0 {
+		data = v.base.Get(outpointKey(txID, vout))
+	}
+	if data == nil {
+		return UTXOEntry{}, ErrMissingInput
+	}
+
+	return DeserializeUTXOEntry(data)
+}
+
+// remove takes the output key out of the view
+func (v *utxoView) remove(key string) {
+	if v.base == nil {
+		delete(v.entries, key)
+		return
+	}
+
+	v.entries[key] = nil
+}
+
+// add spends the outputs referenced by tx's inputs and adds the outputs it
+// creates, as included at height. It returns the spent entries in input
+// order, which make up the undo record of tx.
+func (v *utxoView) add(tx *Transaction, height int) ([]UTXOEntry, error) {
+	var spent []UTXOEntry
+
+	if !tx.IsCoinbase() {
+		for _, vin := range tx.Vin {
+			entry, err := v.lookup(vin.Txid, vin.Vout)
+			if err != nil {
+				return nil, &TxError{tx.ID, err}
+			}
+			spent = append(spent, entry)
+			v.remove(outpointID(vin.Txid, vin.Vout))
+		}
+	}
+
+	for outIdx, out := range tx.Vout {
+		v.entries[outpointID(tx.ID, outIdx)] = &UTXOEntry{out, height, tx.IsCoinbase()}
+	}
+
+	return spent, nil
+}
+
+// disconnect reverts the block, the last one applied to the view, with its
+// undo record, like disconnectUTXO does for the chainstate
+func (v *utxoView) disconnect(block *Block, undo blockUndo) error {
+	spent := undo.Spent
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+
+		for outIdx := range transaction.Vout {
+			v.remove(outpointID(transaction.ID, outIdx))
+		}
+
+		if transaction.IsCoinbase() {
+			continue
+		}
+
+		for j := len(transaction.Vin) - 1; j >= 0; j-- {
+			if len(spent) == 0 {
+				return ErrBadUndoData
+			}
+
+			vin := transaction.Vin[j]
+			entry := spent[len(spent)-1]
+			spent = spent[:len(spent)-1]
+			v.entries[outpointID(vin.Txid, vin.Vout)] = &entry
+		}
+	}
+
+	if len(spent) != 0 {
+		return ErrBadUndoData
+	}
+
+	return nil
+}
+
+// prevOutputs returns the outputs referenced by the inputs of tx, keyed by
+// outpointID, failing if any input refers to a missing or spent output or to
+// a coinbase output that is not mature at the view's height
+func (v *utxoView) prevOutputs(tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
+
+	for _, vin := range tx.Vin {
+		entry, err := v.lookup(vin.Txid, vin.Vout)
+		if err != nil {
+			return nil, err
+		}
+
+		if !entry.IsMature(v.height, v.params.CoinbaseMaturity) {
+			return nil, ErrImmatureSpend
+		}
+
+		prevOuts[outpointID(vin.Txid, vin.Vout)] = entry.Output
+	}
+
+	return prevOuts, nil
+}
+
+// checkTransaction fully validates tx against the view and returns its fee
+func (v *utxoView) checkTransaction(tx *Transaction) (int, error) {
+	err := CheckTransaction(tx, v.params)
+	if err != nil {
+		return 0, err
+	}
+
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	prevOuts, err := v.prevOutputs(tx)
+	if err != nil {
+		return 0, &TxError{tx.ID, err}
+	}
+
+	fee, err := CheckTxInputs(tx, prevOuts, v.params)
+	if err != nil {
+		return 0, err
+	}
+
+	if !tx.Verify(prevOuts) {
+		return 0, &TxError{tx.ID, ErrBadSignature}
+	}
+
+	return fee, nil
+}
+
+// ValidateBlock checks a block against the consensus rules before it is
+// stored. The block's transactions are checked against the branch it
+// extends, which does not have to be the active chain.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	err := checkBlock(block)
+	if err == nil {
+		err = bc.checkBlockContext(block)
+	}
+
+	if err != nil {
+		return &BlockError{block.Hash, err}
+	}
+
+	return nil
+}
+
+// checkBlock runs the checks that do not depend on the rest of the chain
+func checkBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+
+	if block.Bits < minTargetBits || block.Bits > maxTargetBits {
+		return ErrBadDifficulty
+	}
+
+	pow := NewProofOfWork(block)
+	if !bytes.Equal(pow.Hash(), block.Hash) {
+		return ErrBadBlockHash
+	}
+
+	if !pow.Validate() {
+		return ErrBadProofOfWork
+	}
+
+	coinbases := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+
+	if coinbases != 1 {
+		return ErrBadCoinbase
+	}
+
+	return nil
+}
+
+// checkBlockContext checks the block against its parent and the outputs
+// available on its branch
+func (bc *Blockchain) checkBlockContext(block *Block) error {
+	parent, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return ErrUnknownParent
+	}
+
+	err = bc.checkBlockHeader(block, &parent)
+	if err != nil {
+		return err
+	}
+
+	return bc.Db.View(func(tx Tx) error {
+		view, err := utxoViewAt(tx, parent.Hash, bc.Params)
+		if err != nil {
+			return err
+		}
+
+		_, err = bc.checkBlockTransactions(block, view)
+
+		return err
+	})
+}
+
+// checkBlockHeader checks the height, difficulty and timestamp of the block
+// against its parent
+func (bc *Blockchain) checkBlockHeader(block, parent *Block) error {
+	if block.Height != parent.Height+1 {
+		return ErrBadHeight
+	}
+
+	bits, err := bc.nextBits(parent)
+	if err != nil {
+		return err
+	}
+
+	if block.Bits != bits {
+		return ErrBadDifficulty
+	}
+
+	minTime, err := bc.medianTime(parent)
+	if err != nil {
+		return err
+	}
+
+	maxTime := time.Now().Add(maxFutureBlockTime).Unix()
+	if block.Timestamp < minTime || block.Timestamp > maxTime {
+		return ErrBadTimestamp
+	}
+
+	return nil
+}
+
+// checkBlockTransactions checks the block's transactions and coinbase
+// against view, the UTXO set at the block's parent, and adds them to it. It
+// returns the block's undo record.
+func (bc *Blockchain) checkBlockTransactions(block *Block, view *utxoView) (blockUndo, error) {
+	var undo blockUndo
+	reward, fees := 0, 0
+
+	maxMoney := bc.Params.MaxMoney
+
+	for _, tx := range block.Transactions {
+		fee, err := view.checkTransaction(tx)
+		if err != nil {
+			return undo, err
+		}
+
+		if fee > maxMoney-fees {
+			return undo, ErrBadFees
+		}
+		fees += fee
+
+		if tx.IsCoinbase() {
+			height, ok := tx.CoinbaseHeight()
+			if !ok || height != block.Height {
+				return undo, ErrBadCoinbaseHeight
+			}
+
+			for _, out := range tx.Vout {
+				if out.Value > maxMoney-reward {
+					return undo, ErrBadCoinbaseValue
+				}
+				reward += out.Value
+			}
+		}
+
+		spent, err := view.add(tx, block.Height)
+		if err != nil {
+			return undo, err
+		}
+		undo.Spent = append(undo.Spent, spent...)
+	}
+
+	if reward > bc.Params.BlockSubsidy(block.Height)+fees {
+		return undo, ErrBadCoinbaseValue
+	}
+
+	return undo, nil
+}
@@ -0,0 +1,319 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newTestTX returns a transaction spending the given inputs, with its ID set
+func newTestTX(vin []TXInput, vout []TXOutput) *Transaction {
+	tx := &Transaction{nil, vin, vout}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+// newTestSpend returns a transaction signed by wallet sending value from
+// output vout of prev to address
+func newTestSpend(t *testing.T, wallet *Wallet, prev *Transaction, vout int, address string, value int) *Transaction {
+	tx := &Transaction{nil, []TXInput{{prev.ID, vout, nil, wallet.PublicKey}}, []TXOutput{*NewTXOutput(value, address)}}
+
+	err := tx.Sign(wallet.PrivateKet, map[string]TXOutput{outpointID(prev.ID, vout): prev.Vout[vout]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+// newTestBlock mines a block on the tip of bc holding a coinbase claiming
+// fees and transactions, without adding it to the chain
+func newTestBlock(t *testing.T, bc *Blockchain, address string, fees int, transactions ...*Transaction) *Block {
+	tip, err := bc.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := bc.GetBlock(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cbTx, err := NewCoinbaseTX(address, "", parent.Height+1, fees, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := NewBlock(append([]*Transaction{cbTx}, transactions...), tip, parent.Height+1, parent.Bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestValidateBlockRejections(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+2)
+	first := blocks[0].Transactions[0]
+	second := blocks[1].Transactions[0]
+
+	spent := newTestSpend(t, wallet, first, 0, other, first.Vout[0].Value)
+	cbTx, err := NewCoinbaseTX(address, "", len(blocks)+1, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock([]*Transaction{cbTx, spent})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badSignature := newTestSpend(t, wallet, second, 0, other, second.Vout[0].Value)
+	badSignature.Vout[0].PubKeyHash = HashPubKey(wallet.PublicKey)
+	badSignature.ID = badSignature.Hash()
+
+	duplicate := newTestTX(
+		[]TXInput{{second.ID, 0, nil, wallet.PublicKey}, {second.ID, 0, nil, wallet.PublicKey}},
+		[]TXOutput{*NewTXOutput(1, other)},
+	)
+
+	missing := newTestSpend(t, wallet, &Transaction{make([]byte, 32), nil, first.Vout}, 0, other, 1)
+
+	tests := []struct {
+		name  string
+		block *Block
+		err   error
+	}{
+		{"valid", newTestBlock(t, bc, address, 1, newTestSpend(t, wallet, second, 0, other, second.Vout[0].Value-1)), nil},
+		{"missing input", newTestBlock(t, bc, address, 0, missing), ErrMissingInput},
+		{"input spent by an earlier block", newTestBlock(t, bc, address, 0, newTestSpend(t, wallet, first, 0, other, 1)), ErrMissingInput},
+		{"input spent earlier in the block", newTestBlock(t, bc, address, 0, newTestSpend(t, wallet, second, 0, other, 1), newTestSpend(t, wallet, second, 0, address, 1)), ErrSpentInput},
+		{"bad signature", newTestBlock(t, bc, address, 0, badSignature), ErrBadSignature},
+		{"duplicate input", newTestBlock(t, bc, address, 0, duplicate), ErrDuplicateInput},
+		{"coinbase above subsidy and fees", newTestBlock(t, bc, address, 1), ErrBadCoinbaseValue},
+	}
+
+	for _, test := range tests {
+		err := bc.ValidateBlock(test.block)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheckTransactionValueRange(t *testing.T) {
+	params := &RegTestParams
+	wallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(wallet.GetAddress())
+	vin := []TXInput{{[]byte("previous"), 0, nil, wallet.PublicKey}}
+
+	tests := []struct {
+		name   string
+		values []int
+		err    error
+	}{
+		{"max money", []int{params.MaxMoney}, nil},
+		{"above max money", []int{params.MaxMoney + 1}, ErrValueOutOfRange},
+		{"sum above max money", []int{params.MaxMoney, 1}, ErrValueOutOfRange},
+		{"sum wrapping around", []int{int(^uint(0) >> 1), int(^uint(0) >> 1), 2}, ErrValueOutOfRange},
+		{"negative", []int{-1}, ErrBadOutputValue},
+	}
+
+	for _, test := range tests {
+		var vout []TXOutput
+		for _, value := range test.values {
+			vout = append(vout, *NewTXOutput(value, address))
+		}
+
+		err := CheckTransaction(newTestTX(vin, vout), params)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheckTxInputsValueRange(t *testing.T) {
+	params := &RegTestParams
+	wallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(wallet.GetAddress())
+
+	prevID := []byte("previous")
+	prevOuts := map[string]TXOutput{
+		outpointID(prevID, 0): *NewTXOutput(params.MaxMoney, address),
+		outpointID(prevID, 1): *NewTXOutput(params.MaxMoney, address),
+	}
+
+	one := newTestTX(
+		[]TXInput{{prevID, 0, nil, wallet.PublicKey}},
+		[]TXOutput{*NewTXOutput(params.MaxMoney-1, address)},
+	)
+	fee, err := CheckTxInputs(one, prevOuts, params)
+	if err != nil || fee != 1 {
+		t.Errorf("spending one output: fee %d, %v", fee, err)
+	}
+
+	both := newTestTX(
+		[]TXInput{{prevID, 0, nil, wallet.PublicKey}, {prevID, 1, nil, wallet.PublicKey}},
+		[]TXOutput{*NewTXOutput(1, address)},
+	)
+	_, err = CheckTxInputs(both, prevOuts, params)
+	if !errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("spending both outputs: got %v, want %v", err, ErrValueOutOfRange)
+	}
+}
+
+func TestCheckTransactionOutputIndex(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+	coinbase := blocks[0].Transactions[0]
+	value := coinbase.Vout[0].Value
+
+	var wide int64 = 1 << 32
+	aliased := int(wide)
+	if int64(aliased) != wide {
+		t.Skip("int cannot hold an index past four bytes")
+	}
+
+	tests := []struct {
+		name  string
+		vouts []int
+		err   error
+	}{
+		{"negative index", []int{-1}, ErrBadOutputIndex},
+		{"index past four bytes", []int{aliased}, ErrBadOutputIndex},
+		{"index aliasing another input", []int{0, aliased}, ErrBadOutputIndex},
+	}
+
+	for _, test := range tests {
+		var vin []TXInput
+		prevOuts := make(map[string]TXOutput)
+		for _, vout := range test.vouts {
+			vin = append(vin, TXInput{coinbase.ID, vout, nil, wallet.PublicKey})
+			prevOuts[outpointID(coinbase.ID, vout)] = coinbase.Vout[0]
+		}
+		tx := &Transaction{nil, vin, []TXOutput{*NewTXOutput(value*len(vin), address)}}
+		err := tx.Sign(wallet.PrivateKet, prevOuts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.ID = tx.Hash()
+
+		err = CheckTransaction(tx, bc.Params)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+
+		err = bc.VerifyTransaction(tx)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: VerifyTransaction got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyTransactionRejections(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	stranger, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+	first := blocks[0].Transactions[0]
+	value := first.Vout[0].Value
+
+	spend := newTestSpend(t, wallet, first, 0, other, value)
+	err := bc.VerifyTransaction(spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tx   *Transaction
+		err  error
+	}{
+		{"outputs above inputs", newTestSpend(t, wallet, first, 0, other, value+1), ErrInsufficientInput},
+		{"key of another address", newTestSpend(t, stranger, first, 0, other, value), ErrInputKeyMismatch},
+	}
+
+	for _, test := range tests {
+		err := bc.VerifyTransaction(test.tx)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	cbTx, err := NewCoinbaseTX(address, "", len(blocks)+1, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock([]*Transaction{cbTx, spend})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chainstate only holds unspent outputs
+	err = bc.VerifyTransaction(newTestSpend(t, wallet, first, 0, address, 1))
+	if !errors.Is(err, ErrMissingInput) {
+		t.Errorf("spent input: got %v, want %v", err, ErrMissingInput)
+	}
+}
+
+func TestValidateBlockImmatureSpend(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	_, other := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity)
+
+	// The next block is the first the coinbase at height 1 can be spent in
+	mature := blocks[0].Transactions[0]
+	immature := blocks[1].Transactions[0]
+
+	err := bc.ValidateBlock(newTestBlock(t, bc, address, 0, newTestSpend(t, wallet, immature, 0, other, 1)))
+	if !errors.Is(err, ErrImmatureSpend) {
+		t.Errorf("got %v, want %v", err, ErrImmatureSpend)
+	}
+
+	err = bc.ValidateBlock(newTestBlock(t, bc, address, 0, newTestSpend(t, wallet, mature, 0, other, mature.Vout[0].Value)))
+	if err != nil {
+		t.Errorf("spend at maturity: %v", err)
+	}
+}
+
+func TestCoinbaseHeight(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, 2)
+
+	// Coinbases paying the same address have to differ from block to block
+	if bytes.Equal(blocks[0].Transactions[0].ID, blocks[1].Transactions[0].ID) {
+		t.Error("coinbases at different heights share an ID")
+	}
+
+	wrongHeight, err := NewCoinbaseTX(address, "", 2, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := NewBlock([]*Transaction{wrongHeight}, blocks[1].Hash, 3, blocks[1].Bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.ValidateBlock(block)
+	if !errors.Is(err, ErrBadCoinbaseHeight) {
+		t.Errorf("got %v, want %v", err, ErrBadCoinbaseHeight)
+	}
+
+	err = bc.AddBlock(block)
+	if !errors.Is(err, ErrBadCoinbaseHeight) {
+		t.Errorf("adding the block: got %v, want %v", err, ErrBadCoinbaseHeight)
+	}
+}
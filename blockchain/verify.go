@@ -0,0 +1,312 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Levels of checking done by VerifyChain. Each level includes the checks of
+// the levels below it.
+const (
+	// VerifyLinkage checks that blocks load, link to their parent and are
+	// indexed at their height
+	VerifyLinkage = iota
+	// VerifyHeaders checks the hash, merkle root, proof of work, difficulty
+	// and timestamp of blocks
+	VerifyHeaders
+	// VerifyTransactions checks the transactions and signatures of blocks
+	VerifyTransactions
+	// VerifyUTXOSet recomputes the UTXO set from the chain and compares it
+	// with the stored one
+	VerifyUTXOSet
+)
+
+// Reasons the stored chain can fail verification, wrapped in a VerifyError
+var (
+	ErrBadLink            = errors.New("block does not link to the block below it")
+	ErrBadIndex           = errors.New("height index does not point at the block")
+	ErrBadTip             = errors.New("chain tip is not the last block of the height index")
+	ErrChainstateMismatch = errors.New("chainstate entry does not match the chain")
+	ErrChainstateMissing  = errors.New("chainstate is missing unspent outputs")
+	ErrUTXOAddrMismatch   = errors.New("address index of the UTXO set does not match the chainstate")
+)
+
+// VerifyError reports the first problem found by VerifyChain, and the block
+// and transaction it was found in. Problems of the chainstate that no block
+// of the chain accounts for have a Height of -1 and no Hash.
+type VerifyError struct {
+	Height int
+	Hash   []byte
+	TxID   []byte
+	Err    error
+}
+
+func (e *VerifyError) Error() string {
+	var where string
+	switch {
+	case e.Hash != nil:
+		where = fmt.Sprintf("block %x at height %d", e.Hash, e.Height)
+	case e.Height >= 0:
+		where = fmt.Sprintf("block at height %d", e.Height)
+	default:
+		where = "chainstate"
+	}
+
+	if e.TxID != nil {
+		where += fmt.Sprintf(", transaction %x", e.TxID)
+	}
+
+	return fmt.Sprintf("%s: %s", where, e.Err)
+}
+
+// Unwrap returns the reason verification failed
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyChain rechecks the last depth blocks of the active chain, or all of
+// them when depth is not positive, up to the given level. It returns a
+// VerifyError describing the first failure.
+func (bc *Blockchain) VerifyChain(depth, level int) error {
+	tipHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	if depth > 0 && depth <= tipHeight {
+		start = tipHeight + 1 - depth
+	}
+
+	tip, err := bc.Tip()
+	if err != nil {
+		return err
+	}
+
+	prevHash, err := bc.verifyRange(start, tipHeight, level, nil)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(prevHash, tip) {
+		return &VerifyError{tipHeight, prevHash, nil, ErrBadTip}
+	}
+
+	if level >= VerifyUTXOSet {
+		txID, height, err := bc.verifyUTXOSet(tip)
+		if err != nil {
+			verr := &VerifyError{-1, nil, txID, err}
+
+			if height >= 0 {
+				verr.Height = height
+				verr.Hash, err = bc.GetBlockHashByHeight(height)
+				if err != nil {
+					return err
+				}
+			}
+
+			return verr
+		}
+	}
+
+	return nil
+}
+
+// verifyRange checks the active chain's blocks from height start to end up to
+// level, and returns the hash of the last one. When transactions are checked
+// and connected is not nil, it is called with every block that passes, the
+// outputs the block spent and the view of the UTXO set the block ends at; its
+// errors are returned as they are.
+func (bc *Blockchain) verifyRange(start, end, level int, connected func(*Block, blockUndo, *utxoView) error) ([]byte, error) {
+	var prevHash []byte
+	var err error
+	view := newUTXOView(nil, 0, bc.Params)
+
+	if start > 0 {
+		prevHash, err = bc.GetBlockHashByHeight(start - 1)
+		if err != nil {
+			return nil, &VerifyError{start - 1, nil, nil, err}
+		}
+
+		if level >= VerifyTransactions {
+			UTXO, err := bc.findUTXOAt(prevHash)
+			if err != nil {
+				return nil, &VerifyError{start - 1, prevHash, nil, err}
+			}
+
+			for key := range UTXO {
+				entry := UTXO[key]
+				view.entries[key] = &entry
+			}
+		}
+	}
+
+	for height := start; height <= end; height++ {
+		hash, err := bc.GetBlockHashByHeight(height)
+		if err != nil {
+			return nil, &VerifyError{height, nil, nil, err}
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, &VerifyError{height, hash, nil, err}
+		}
+
+		undo, err := bc.verifyBlock(&block, hash, prevHash, view, level)
+		if err != nil {
+			verr := &VerifyError{height, hash, nil, err}
+
+			var txErr *TxError
+			if errors.As(err, &txErr) {
+				verr.TxID = txErr.ID
+				verr.Err = txErr.Err
+			}
+
+			return nil, verr
+		}
+
+		if connected != nil && level >= VerifyTransactions {
+			err = connected(&block, undo, view)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		prevHash = hash
+	}
+
+	return prevHash, nil
+}
+
+// verifyBlock checks the block indexed as hash, whose parent is indexed as
+// prevHash, up to level. view holds the UTXO set at the parent. When
+// transactions are checked, it returns the outputs the block spent.
+func (bc *Blockchain) verifyBlock(block *Block, hash, prevHash []byte, view *utxoView, level int) (blockUndo, error) {
+	if !bytes.Equal(block.Hash, hash) {
+		return blockUndo{}, ErrBadIndex
+	}
+
+	if block.Height == 0 {
+		if len(block.PrevBlockHash) != 0 || !bytes.Equal(hash, GenesisBlock(bc.Params).Hash) {
+			return blockUndo{}, ErrGenesisMismatch
+		}
+	} else if !bytes.Equal(block.PrevBlockHash, prevHash) {
+		return blockUndo{}, ErrBadLink
+	}
+
+	if level < VerifyHeaders {
+		return blockUndo{}, nil
+	}
+
+	err := checkBlock(block)
+	if err != nil {
+		return blockUndo{}, err
+	}
+
+	if block.Height > 0 {
+		parent, err := bc.GetBlock(prevHash)
+		if err != nil {
+			return blockUndo{}, err
+		}
+
+		err = bc.checkBlockHeader(block, &parent)
+		if err != nil {
+			return blockUndo{}, err
+		}
+	}
+
+	if level < VerifyTransactions {
+		return blockUndo{}, nil
+	}
+
+	view.height = block.Height
+
+	return bc.checkBlockTransactions(block, view)
+}
+
+// verifyUTXOSet recomputes the UTXO set from the active chain ending at tip
+// and compares it with the chainstate bucket, whose address index has to
+// hold exactly its outputs. On failure it returns the ID of the transaction
+// whose output is wrong, and the height of the block holding it, or -1 when
+// the output does not belong to the chain.
+func (bc *Blockchain) verifyUTXOSet(tip []byte) ([]byte, int, error) {
+	UTXO, err := bc.findUTXOAt(tip)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	var txID []byte
+	height := -1
+	count := 0
+
+	err = bc.Db.View(func(tx Tx) error {
+		if !utxoInSync(tx, tip) {
+			return ErrUTXOMismatch
+		}
+
+		addrIndex := tx.Bucket([]byte(utxoAddrBucket))
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			key := hex.EncodeToString(k)
+			entry, err := DeserializeUTXOEntry(v)
+			want, ok := UTXO[key]
+
+			if err != nil || !ok || !bytes.Equal(entry.Serialize(), want.Serialize()) {
+				if len(k) == outpointSize {
+					k, _ = splitOutpointKey(k)
+				}
+				txID = append([]byte{}, k...)
+				if ok {
+					height = want.Height
+				}
+				return ErrChainstateMismatch
+			}
+
+			if addrIndex.Get(utxoAddrKey(entry.Output.PubKeyHash, k)) == nil {
+				txID, _ = splitOutpointKey(k)
+				txID = append([]byte{}, txID...)
+				height = want.Height
+				return ErrUTXOAddrMismatch
+			}
+
+			delete(UTXO, key)
+			count++
+		}
+
+		ic := addrIndex.Cursor()
+		for k, _ := ic.First(); k != nil; k, _ = ic.Next() {
+			count--
+		}
+
+		return nil
+	})
+	if err != nil {
+		return txID, height, err
+	}
+
+	if len(UTXO) > 0 {
+		var missing []string
+		for key := range UTXO {
+			missing = append(missing, key)
+		}
+		sort.Strings(missing)
+
+		key, err := hex.DecodeString(missing[0])
+		if err != nil {
+			return nil, -1, err
+		}
+		txID, _ = splitOutpointKey(key)
+
+		return txID, UTXO[missing[0]].Height, ErrChainstateMissing
+	}
+
+	if count != 0 {
+		return nil, -1, ErrUTXOAddrMismatch
+	}
+
+	return nil, -1, nil
+}
@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// verifyError runs VerifyChain at level and returns the VerifyError it fails
+// with
+func verifyError(t *testing.T, bc *Blockchain, depth, level int) *VerifyError {
+	err := bc.VerifyChain(depth, level)
+
+	var verr *VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("VerifyChain returned %v, want a VerifyError", err)
+	}
+
+	return verr
+}
+
+func TestVerifyChain(t *testing.T) {
+	bc := newTestChain(t)
+	_, address := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, 5)
+
+	err := bc.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := *blocks[3]
+	tampered.Timestamp++
+	err = bc.Db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(blocksBucket)).Put(tampered.Hash, tampered.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.VerifyChain(0, VerifyLinkage)
+	if err != nil {
+		t.Errorf("linkage checks failed on a block with a bad hash: %v", err)
+	}
+
+	verr := verifyError(t, bc, 0, VerifyHeaders)
+	if !errors.Is(verr, ErrBadBlockHash) || verr.Height != tampered.Height {
+		t.Errorf("got %v, want %v at height %d", verr, ErrBadBlockHash, tampered.Height)
+	}
+
+	err = bc.VerifyChain(1, VerifyHeaders)
+	if err != nil {
+		t.Errorf("checking the last block only: %v", err)
+	}
+}
+
+func TestVerifyUTXOSetReportsBlock(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, 5)
+	coinbase := blocks[2].Transactions[0]
+
+	err := bc.Db.Update(func(tx Tx) error {
+		return deleteUTXO(tx, outpointKey(coinbase.ID, 0), coinbase.Vout[0].PubKeyHash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verr := verifyError(t, bc, 0, VerifyUTXOSet)
+	if !errors.Is(verr, ErrChainstateMissing) {
+		t.Fatalf("got %v, want %v", verr, ErrChainstateMissing)
+	}
+	if verr.Height != blocks[2].Height || !bytes.Equal(verr.Hash, blocks[2].Hash) || !bytes.Equal(verr.TxID, coinbase.ID) {
+		t.Errorf("missing output reported in block %x at height %d, transaction %x", verr.Hash, verr.Height, verr.TxID)
+	}
+
+	// An output no block created is not blamed on any block
+	err = bc.Db.Update(func(tx Tx) error {
+		err := putUTXO(tx, outpointKey(coinbase.ID, 0), UTXOEntry{coinbase.Vout[0], blocks[2].Height, true})
+		if err != nil {
+			return err
+		}
+
+		out := NewTXOutput(1, address)
+		return putUTXO(tx, outpointKey(make([]byte, 32), 0), UTXOEntry{*out, 4, false})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verr = verifyError(t, bc, 0, VerifyUTXOSet)
+	if !errors.Is(verr, ErrChainstateMismatch) || verr.Height != -1 || verr.Hash != nil {
+		t.Errorf("got %v at height %d, want %v in no block", verr, verr.Height, ErrChainstateMismatch)
+	}
+
+	// So is an address index entry no output accounts for
+	err = bc.Db.Update(func(tx Tx) error {
+		return deleteUTXO(tx, outpointKey(make([]byte, 32), 0), HashPubKey(wallet.PublicKey))
+	})
+	if err == nil {
+		err = bc.Db.Update(func(tx Tx) error {
+			key := utxoAddrKey(HashPubKey(wallet.PublicKey), outpointKey(make([]byte, 32), 1))
+			return tx.Bucket([]byte(utxoAddrBucket)).Put(key, []byte{})
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verr = verifyError(t, bc, 0, VerifyUTXOSet)
+	if !errors.Is(verr, ErrUTXOAddrMismatch) || verr.Height != -1 || verr.Hash != nil {
+		t.Errorf("got %v at height %d, want %v in no block", verr, verr.Height, ErrUTXOAddrMismatch)
+	}
+}
+
+func TestVerifyChainSpendWithinBlock(t *testing.T) {
+	bc := newTestChain(t)
+	wallet, address := newTestWallet(t)
+	other, otherAddress := newTestWallet(t)
+	blocks := mineBlocks(t, bc, address, bc.Params.CoinbaseMaturity+1)
+	coinbase := blocks[0].Transactions[0]
+	value := coinbase.Vout[0].Value
+
+	// The second transaction spends the output of the first in the same
+	// block, which leaves only its own output unspent
+	first := newTestSpend(t, wallet, coinbase, 0, otherAddress, value)
+	second := newTestSpend(t, other, first, 0, address, value)
+	height := len(blocks) + 1
+	cbTx, err := NewCoinbaseTX(address, "", height, 0, bc.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock([]*Transaction{cbTx, first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking only the block above it starts from the UTXO set computed
+	// from the chain
+	mineBlocks(t, bc, address, 1)
+	err = bc.VerifyChain(1, VerifyUTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,39 +6,63 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"log"
+	"errors"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
+// ErrInvalidAddress is returned when an address fails to decode or its
+// checksum does not match
+var ErrInvalidAddress = errors.New("invalid address")
+
 type Wallet struct {
 	PrivateKet ecdsa.PrivateKey
 	PublicKey  []byte
+	version    byte
 }
 
-func NewWallet() *Wallet {
-	private, public := newKeyPair()
+// NewWallet creates a Wallet with a freshly generated key pair, whose address
+// belongs to the network of params
+func NewWallet(params *ChainParams) (*Wallet, error) {
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
 
-	return &Wallet{private, public}
+	return &Wallet{private, public, params.AddressVersion}, nil
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
+func newKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Fatal(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
-	pubkey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubkey := joinInts(private.PublicKey.X, private.PublicKey.Y)
 
-	return *private, pubkey
+	return *private, pubkey, nil
 }
 
-const version = byte(0x00)
+// intSize is the length of a P-256 coordinate or signature half
+const intSize = 32
+
+// joinInts encodes a pair of P-256 numbers, a public key or a signature, as
+// two fixed length halves. Big.Int drops leading zero bytes, which would move
+// the middle the pair is split at.
+func joinInts(a, b *big.Int) []byte {
+	buf := make([]byte, 2*intSize)
+	aBytes, bBytes := a.Bytes(), b.Bytes()
+	copy(buf[intSize-len(aBytes):intSize], aBytes)
+	copy(buf[2*intSize-len(bBytes):], bBytes)
+
+	return buf
+}
 
 func (w Wallet) GetAddress() []byte {
 	pubKeyHash := HashPubKey(w.PublicKey)
 
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+	versionedPayload := append([]byte{w.version}, pubKeyHash...)
 
 	fullPayload := append(versionedPayload, checksum(versionedPayload)...)
 	address := Base58Encode(fullPayload)
@@ -46,10 +70,19 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
 
-func ValidateAddress(address string) bool {
+// ValidateAddress reports whether address belongs to the network of params
+// and decodes to a payload with a matching checksum
+func ValidateAddress(address string, params *ChainParams) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= 1+addressChecksumLen {
+		return false
+	}
+
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
+	if version != params.AddressVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 
@@ -60,10 +93,8 @@ func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
 
 	RIPEMD160Hasher := ripemd160.New()
-	_, err := RIPEMD160Hasher.Write(publicSHA256[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	// Writing to a hash never returns an error
+	RIPEMD160Hasher.Write(publicSHA256[:])
 	publicRIPEMD160 := RIPEMD160Hasher.Sum(nil)
 
 	return publicRIPEMD160
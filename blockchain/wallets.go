@@ -2,87 +2,206 @@ package blockchain
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"os"
 )
 
-// Wallets stores a collection of Wallet
+// ErrWalletNotFound is returned when the wallet file holds no key for an
+// address
+var ErrWalletNotFound = errors.New("wallet not found")
+
+// Wallets stores a collection of Wallet of a network
 type Wallets struct {
 	Wallets map[string]*Wallet
+	params  *ChainParams
+}
+
+// walletKey is how a Wallet is saved. gob cannot encode the curve of an
+// ecdsa.PrivateKey, so only the private scalar is kept and the rest of the
+// key is derived from it when loading.
+type walletKey struct {
+	D []byte
+}
+
+// legacyWalletFile is the name wallets were saved under in the working
+// directory of a node before data directories
+const legacyWalletFile = "wallet_%s.dat"
+
+// legacyWallets is the layout of wallet files saved before walletKey: a gob of
+// Wallets holding whole ecdsa.PrivateKey values. Only the private scalar is
+// decoded, the public key and its curve are skipped.
+type legacyWallets struct {
+	Wallets map[string]*struct {
+		PrivateKet struct {
+			D *big.Int
+		}
+	}
 }
 
 // NewWallets creates Wallets and fills it from a file if it exists
-func NewWallets(nodeID string) (*Wallets, error) {
+func NewWallets(dataDir DataDir, params *ChainParams) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.params = params
 
-	err := wallets.LoadFromFile(nodeID)
+	err := wallets.LoadFromFile(dataDir)
 
 	return &wallets, err
 }
 
 // CreateWallet adds a Wallet to Wallets
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+func (ws *Wallets) CreateWallet() (string, error) {
+	wallet, err := NewWallet(ws.params)
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 // GetWallet returns a Wallet by its address
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
-}
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, ErrWalletNotFound
+	}
 
-const walletFile string = "wallet_%s.dat"
+	return *wallet, nil
+}
 
-// LoadFromFile loads wallets from a file on disk
-func (ws *Wallets) LoadFromFile(nodeID string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+// LoadFromFile loads wallets from the wallet file of the data directory
+func (ws *Wallets) LoadFromFile(dataDir DataDir) error {
+	walletFile := dataDir.WalletFile()
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	var wallets Wallets
-	gob.Register(elliptic.P256())
+	var keys map[string]walletKey
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err = decoder.Decode(&keys)
 	if err != nil {
-		log.Panic(err)
+		// files of the old format are saved in the new one on the next save
+		keys, err = decodeLegacyWallets(fileContent, ws.params)
+		if err != nil {
+			return err
+		}
+	}
+
+	wallets := make(map[string]*Wallet)
+	for address, key := range keys {
+		wallets[address] = walletFromKey(key, ws.params)
 	}
 
-	ws.Wallets = wallets.Wallets
+	ws.Wallets = wallets
 	return nil
 }
 
-// SaveToFile saves wallets to a file
-func (ws Wallets) SaveToFile(nodeID string) {
+// decodeLegacyWallets returns the keys of a wallet file of the old format,
+// by their address on the network of params
+func decodeLegacyWallets(data []byte, params *ChainParams) (map[string]walletKey, error) {
+	var wallets legacyWallets
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&wallets)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]walletKey)
+	for address, wallet := range wallets.Wallets {
+		if wallet == nil || wallet.PrivateKet.D == nil {
+			return nil, fmt.Errorf("wallet file holds no key for %s", address)
+		}
+		key := walletKey{wallet.PrivateKet.D.Bytes()}
+		keys[string(walletFromKey(key, params).GetAddress())] = key
+	}
+
+	return keys, nil
+}
+
+// LegacyWalletFile returns the path, relative to the working directory, that
+// the wallets of node nodeID were saved to before data directories
+func LegacyWalletFile(nodeID string) string {
+	return fmt.Sprintf(legacyWalletFile, nodeID)
+}
+
+// MigrateLegacyWallets saves the keys of the old format wallet file legacyFile
+// to the wallet file of the data directory, under addresses of the network
+// of params. It does nothing when the data directory already has a wallet
+// file or legacyFile does not exist, and returns the number of keys saved.
+// legacyFile is left in place.
+func MigrateLegacyWallets(legacyFile string, dataDir DataDir, params *ChainParams) (int, error) {
+	if _, err := os.Stat(dataDir.WalletFile()); !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	fileContent, err := ioutil.ReadFile(legacyFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := decodeLegacyWallets(fileContent, params)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", legacyFile, err)
+	}
+
+	wallets := Wallets{make(map[string]*Wallet), params}
+	for address, key := range keys {
+		wallets.Wallets[address] = walletFromKey(key, params)
+	}
+
+	return len(keys), wallets.SaveToFile(dataDir)
+}
+
+// SaveToFile saves wallets to the wallet file of the data directory
+func (ws Wallets) SaveToFile(dataDir DataDir) error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeID)
 
-	gob.Register(elliptic.P256())
+	keys := make(map[string]walletKey)
+	for address, wallet := range ws.Wallets {
+		keys[address] = walletKey{wallet.PrivateKet.D.Bytes()}
+	}
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+	err := encoder.Encode(keys)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = dataDir.Create()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	return ioutil.WriteFile(dataDir.WalletFile(), content.Bytes(), 0600)
+}
+
+// walletFromKey rebuilds a Wallet of the network of params from its private
+// scalar
+func walletFromKey(key walletKey, params *ChainParams) *Wallet {
+	curve := elliptic.P256()
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(key.D)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(key.D)
+	pubkey := joinInts(private.PublicKey.X, private.PublicKey.Y)
+
+	return &Wallet{private, pubkey, params.AddressVersion}
 }
 
 // GetAddresses returns an array of addresses stored in the wallet file
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/gob"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyCurve stands in for the curve type gob encoded in old wallet files
+type legacyCurve struct {
+	*elliptic.CurveParams
+}
+
+func init() {
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyCurve{})
+}
+
+// writeLegacyWallets saves wallets the way wallet files were saved before
+// walletKey, with whole private keys and their curve
+func writeLegacyWallets(t *testing.T, path string, wallets ...*Wallet) {
+	type legacyKey struct {
+		PublicKey struct {
+			Curve elliptic.Curve
+			X, Y  *big.Int
+		}
+		D *big.Int
+	}
+	type legacyWallet struct {
+		PrivateKet legacyKey
+		PublicKey  []byte
+	}
+
+	file := struct {
+		Wallets map[string]*legacyWallet
+	}{make(map[string]*legacyWallet)}
+
+	for _, wallet := range wallets {
+		var key legacyKey
+		key.PublicKey.Curve = legacyCurve{elliptic.P256().Params()}
+		key.PublicKey.X = wallet.PrivateKet.X
+		key.PublicKey.Y = wallet.PrivateKet.Y
+		key.D = wallet.PrivateKet.D
+		file.Wallets[string(wallet.GetAddress())] = &legacyWallet{key, wallet.PublicKey}
+	}
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path, content.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyWallets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wallets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := &MainNetParams
+	dataDir := DataDir{dir, params.Name}
+	legacyFile := filepath.Join(dir, LegacyWalletFile("3000"))
+
+	wallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLegacyWallets(t, legacyFile, wallet)
+
+	migrated, err := MigrateLegacyWallets(legacyFile, dataDir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("migrated %d keys, want 1", migrated)
+	}
+
+	wallets, err := NewWallets(dataDir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := wallets.GetWallet(string(wallet.GetAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey, wallet.PublicKey) {
+		t.Errorf("migrated public key %x, want %x", loaded.PublicKey, wallet.PublicKey)
+	}
+
+	migrated, err = MigrateLegacyWallets(legacyFile, dataDir, params)
+	if err != nil || migrated != 0 {
+		t.Errorf("second migration saved %d keys, %v", migrated, err)
+	}
+}
+
+func TestLoadLegacyWalletFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wallets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := &RegTestParams
+	dataDir := DataDir{dir, params.Name}
+	err = dataDir.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLegacyWallets(t, dataDir.WalletFile(), wallet)
+
+	wallets, err := NewWallets(dataDir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wallets.GetWallet(string(wallet.GetAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+}